@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
@@ -9,16 +10,41 @@ import (
 	"github.com/garyburd/redigo/redis"
 )
 
+var ErrUserNameTaken = errors.New("Sorry the selected username is already in use.")
+
 type DBHelper struct {
 	err error
 }
 
+func (helper *DBHelper) createUser(userName string, password string) string {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var userId int
+	userId, helper.err = redis.Int(claimUserScript.Do(redisConn, "users", "next_user_id", "users_by_time",
+		userNameKey(userName), userName, password, time.Now().Unix()))
+	if helper.err == redis.ErrNil {
+		helper.err = ErrUserNameTaken
+	}
+	if helper.err != nil {
+		return ""
+	}
+
+	return strconv.Itoa(userId)
+}
+
 func (helper *DBHelper) loadUserInfo(userId string) *User {
 	redisConn := redisPool.Get()
 	defer redisConn.Close()
 
 	var value []interface{}
 	value, helper.err = redis.Values(redisConn.Do("HGETALL", "user:"+userId))
+	if helper.err == nil && len(value) == 0 {
+		helper.err = redis.ErrNil
+	}
+	if helper.err != nil {
+		return nil
+	}
 	user := &User{}
 	helper.err = redis.ScanStruct(value, user)
 	if helper.err != nil {
@@ -28,16 +54,25 @@ func (helper *DBHelper) loadUserInfo(userId string) *User {
 }
 
 func (helper *DBHelper) getUserFromName(userName string) *User {
-	redisConn := redisPool.Get()
-	defer redisConn.Close()
-
-	var value string
-	value, helper.err = redis.String(redisConn.Do("HGET", "users", userName))
+	userId := helper.getUserId(userName)
+	if helper.err != nil {
+		return nil
+	}
 
-	return helper.loadUserInfo(value)
+	return helper.loadUserInfo(userId)
 }
 
+// getPost loads the post with the post it quotes, the UserId is empty when
+// there is no such post.
 func (helper *DBHelper) getPost(postId string) *Post {
+	post := helper.loadPost(postId)
+	if helper.err == nil && post.QuoteOf != "" {
+		post.Quoted = helper.loadQuote(post.QuoteOf)
+	}
+	return post
+}
+
+func (helper *DBHelper) loadPost(postId string) *Post {
 	redisConn := redisPool.Get()
 	defer redisConn.Close()
 
@@ -45,12 +80,21 @@ func (helper *DBHelper) getPost(postId string) *Post {
 	values, helper.err = redis.Values(redisConn.Do("HGETALL", "post:"+postId))
 	post := &Post{}
 	helper.err = redis.ScanStruct(values, post)
-
-	post.UserName, helper.err = redis.String(redisConn.Do("hget", "user:"+post.UserId, "userName"))
+	post.Id = postId
+	post.Posted, _ = strconv.ParseInt(post.Time, 10, 64)
+	post.Attachments = parseAttachments(post.AttachmentData)
+	post.Mentions = mentionIds(parseMentions(post.MentionData))
+	post.Tags = parseTags(post.TagData)
+
+	var author []string
+	author, helper.err = redis.Strings(redisConn.Do("HMGET", "user:"+post.UserId, "userName", "avatar"))
+	if helper.err == nil {
+		post.UserName, post.Avatar = author[0], author[1]
+	}
 	return post
 }
 
-func (helper *DBHelper) getUserPosts(userId string, start int64, count int64) ([]*Post, int64) {
+func (helper *DBHelper) getUserPosts(userId string, viewerId string, start int64, count int64) ([]*Post, int64) {
 	redisConn := redisPool.Get()
 	defer redisConn.Close()
 
@@ -62,13 +106,18 @@ func (helper *DBHelper) getUserPosts(userId string, start int64, count int64) ([
 	posts := []*Post{}
 
 	for _, postId := range values {
-		post := helper.getPost(postId)
+		post := helper.resolvePost(postId)
+		// Posts of deleted accounts may linger until the deletion is done.
+		if post.UserId == "" {
+			continue
+		}
 		post.Time = strElapsed(post.Time)
 		posts = append(posts, post)
 	}
 
 	length, helper.err = redis.Int64(redisConn.Do("LLEN", "posts:"+userId))
 
+	helper.loadPostStats(posts, viewerId)
 	if helper.err != nil {
 		return posts, 0
 	} else {
@@ -105,29 +154,148 @@ func (helper *DBHelper) getFollowing(userId string) int {
 
 }
 
-func (helper *DBHelper) post(userId string, body string) {
+// post stores the post with the UserId, Body, Attachments, InReplyTo,
+// RepostOf and QuoteOf set by the caller and delivers it, it returns the id
+// of the post.
+func (helper *DBHelper) post(post *Post) string {
 	redisConn := redisPool.Get()
 	defer redisConn.Close()
 
 	var (
 		postId    int
-		userName  string
 		followers []string
+		parent    *Post
+		original  *Post
+		quoted    *Post
 	)
-	body = strings.Replace(body, "\n", " ", -1)
+	if post.InReplyTo != "" {
+		parent = helper.resolvePost(post.InReplyTo)
+		if helper.err == nil && parent.UserId == "" {
+			helper.err = ErrPostNotFound
+		}
+		if helper.err != nil {
+			return ""
+		}
+		post.InReplyTo = parent.Id
+	}
+	if post.RepostOf != "" {
+		original = helper.resolvePost(post.RepostOf)
+		if helper.err == nil && original.UserId == "" {
+			helper.err = ErrPostNotFound
+		}
+		if helper.err == nil && original.UserId == post.UserId {
+			helper.err = ErrRepostOwn
+		}
+		if helper.err == nil && parent != nil {
+			helper.err = ErrRepostReply
+		}
+		if helper.err != nil {
+			return ""
+		}
+		post.RepostOf = original.Id
+		post.Body, post.Attachments, post.QuoteOf = "", nil, ""
+	}
+	if post.QuoteOf != "" {
+		quoted = helper.resolvePost(post.QuoteOf)
+		if helper.err == nil && quoted.UserId == "" {
+			helper.err = ErrPostNotFound
+		}
+		if helper.err != nil {
+			return ""
+		}
+		post.QuoteOf = quoted.Id
+	}
+
+	userId := post.UserId
+	post.Body = strings.Replace(post.Body, "\n", " ", -1)
+	mentions := helper.findMentions(post.Body)
+	if helper.err != nil {
+		return ""
+	}
+	post.MentionData = encodeMentions(mentions)
+	post.Mentions = mentionIds(mentions)
+	post.Tags = findTags(post.Body)
+	post.TagData = strings.Join(post.Tags, " ")
 	postId, helper.err = redis.Int(redisConn.Do("INCR", "next_post_id"))
-	userName, helper.err = redis.String(redisConn.Do("hget", "user:"+userId, "userName"))
-	post := Post{userId, strconv.FormatInt(time.Now().Unix(), 10), body, userName}
-	tableName := "post:" + strconv.Itoa(postId)
-	_, helper.err = redisConn.Do("HMSET", redis.Args{}.Add(tableName).AddFlat(&post)...)
+	post.UserName, helper.err = redis.String(redisConn.Do("hget", "user:"+userId, "userName"))
+	post.Id = strconv.Itoa(postId)
+	if original != nil {
+		// Claim the repost first, a second click must not repost again.
+		var claimed bool
+		claimed, helper.err = redis.Bool(redisConn.Do("HSETNX", "reposts:"+original.Id, userId, post.Id))
+		if helper.err != nil || !claimed {
+			return ""
+		}
+	}
+	post.Posted = time.Now().Unix()
+	post.Time = strconv.FormatInt(post.Posted, 10)
+	post.AttachmentData = encodeAttachments(post.Attachments)
+	tableName := "post:" + post.Id
+	_, helper.err = redisConn.Do("HMSET", redis.Args{}.Add(tableName).AddFlat(post)...)
 	followers, helper.err = redis.Strings(redisConn.Do("ZRANGE", "followers:"+userId, 0, -1))
+	if parent != nil && parent.UserId != userId {
+		followers = helper.replyAudience(followers, parent)
+	}
 	followers = append(followers, userId)
+	if original != nil {
+		followers = helper.deliverRepost(original, post.Id, followers)
+	}
 
 	for _, followerID := range followers {
 		_, helper.err = redisConn.Do("LPUSH", "posts:"+followerID, postId)
 	}
-	_, helper.err = redisConn.Do("LPUSH", "timeline", postId)
-	_, helper.err = redisConn.Do("LTRIM", "timeline", 0, 2000)
+	if original == nil {
+		redisConn.Send("MULTI")
+		for _, followerID := range followers {
+			redisConn.Send("HSETNX", "delivered:"+post.Id, followerID, 0)
+		}
+		redisConn.Send("EXPIRE", "delivered:"+post.Id, deliveredTTL)
+		_, helper.err = redisConn.Do("EXEC")
+	}
+	_, helper.err = redisConn.Do("LPUSH", "user_posts:"+userId, postId)
+	if original == nil {
+		_, helper.err = redisConn.Do("LPUSH", "timeline", postId)
+		_, helper.err = redisConn.Do("LTRIM", "timeline", 0, 2000)
+	}
+
+	for _, key := range post.Tags {
+		_, helper.err = redisConn.Do("ZADD", "tag:"+key, post.Posted, postId)
+	}
+
+	if parent != nil {
+		_, helper.err = redisConn.Do("ZADD", "replies:"+parent.Id, post.Posted, postId)
+		if parent.UserId != userId {
+			helper.notify(parent.UserId, &Notification{
+				Kind: "reply",
+				Text: post.UserName + " replied to your post",
+				Link: "/post/" + post.Id,
+			})
+		}
+	}
+	if quoted != nil && quoted.UserId != userId {
+		helper.notify(quoted.UserId, &Notification{
+			Kind: "quote",
+			Text: post.UserName + " quoted your post",
+			Link: "/post/" + post.Id,
+		})
+	}
+	if original != nil {
+		helper.notify(original.UserId, &Notification{
+			Kind: "repost",
+			Text: post.UserName + " reposted your post",
+			Link: "/post/" + original.Id,
+		})
+	}
+
+	notified := []string{}
+	if parent != nil {
+		notified = append(notified, parent.UserId)
+	}
+	if quoted != nil {
+		notified = append(notified, quoted.UserId)
+	}
+	helper.deliverMentions(post, post.Mentions, notified...)
+	return post.Id
 }
 
 func (helper *DBHelper) getLatestUsers() []*User {
@@ -146,7 +314,7 @@ func (helper *DBHelper) getLatestUsers() []*User {
 
 	return users
 }
-func (helper *DBHelper) getLatestTimeLine(start int64, count int64) ([]*Post, int64) {
+func (helper *DBHelper) getLatestTimeLine(viewerId string, start int64, count int64) ([]*Post, int64) {
 	redisConn := redisPool.Get()
 	defer redisConn.Close()
 
@@ -158,7 +326,10 @@ func (helper *DBHelper) getLatestTimeLine(start int64, count int64) ([]*Post, in
 	values, helper.err = redis.Strings(redisConn.Do("LRANGE", "timeline", start, start+count-1))
 
 	for _, postId := range values {
-		post := helper.getPost(postId)
+		post := helper.resolvePost(postId)
+		if post.UserId == "" {
+			continue
+		}
 
 		post.Time = strElapsed(post.Time)
 		posts = append(posts, post)
@@ -166,6 +337,7 @@ func (helper *DBHelper) getLatestTimeLine(start int64, count int64) ([]*Post, in
 
 	length, helper.err = redis.Int64(redisConn.Do("LLEN", "timeline"))
 
+	helper.loadPostStats(posts, viewerId)
 	if helper.err != nil {
 		return posts, 0
 	} else {
@@ -1,18 +1,24 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"net/http"
+	"time"
 )
 
+// Static serves the files in Dir. With a MaxAge the files are cached by
+// browsers and proxies, only use it for files which never change.
 type Static struct {
-	Dir http.FileSystem
+	Dir    http.FileSystem
+	MaxAge time.Duration
 }
 
 func (s *Static) saticHandler(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method != "GET" && r.Method != "HEAD" {
 		WriteError(w, ErrNotFound)
+		return
 	}
 
 	log.Printf("path is %s", r.URL.Path)
@@ -33,5 +39,14 @@ func (s *Static) saticHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if fi.IsDir() {
+		WriteError(w, ErrNotFound)
+		return
+	}
+
+	if s.MaxAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", int(s.MaxAge.Seconds())))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+	}
 	http.ServeContent(w, r, file, fi.ModTime(), f)
 }
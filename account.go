@@ -0,0 +1,390 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/context"
+)
+
+const resetTokenTTL = 60 * 60
+
+var ErrEmailTaken = errors.New("Sorry the email address is already used by another account.")
+
+func parseEmail(email string) (string, error) {
+	addr, err := mail.ParseAddress(email)
+	if err != nil {
+		return "", errors.New("Please enter a valid email address.")
+	}
+	return addr.Address, nil
+}
+
+func (helper *DBHelper) getUserFromEmail(email string) *User {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var value string
+	value, helper.err = redis.String(redisConn.Do("HGET", "emails", strings.ToLower(email)))
+	if helper.err != nil {
+		return nil
+	}
+	return helper.loadUserInfo(value)
+}
+
+// setEmail claims the address in the emails hash before storing it on the
+// user, releasing the previous one.
+func (helper *DBHelper) setEmail(user *User, email string) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	key := strings.ToLower(email)
+	if key == strings.ToLower(user.Email) {
+		return
+	}
+
+	var claimed bool
+	claimed, helper.err = redis.Bool(redisConn.Do("HSETNX", "emails", key, user.UserId))
+	if helper.err != nil {
+		return
+	}
+	if !claimed {
+		helper.err = ErrEmailTaken
+		return
+	}
+
+	_, helper.err = redisConn.Do("HMSET", "user:"+user.UserId, "email", email, "emailVerified", false)
+	if helper.err != nil {
+		return
+	}
+	if user.Email != "" {
+		_, helper.err = redisConn.Do("HDEL", "emails", strings.ToLower(user.Email))
+	}
+	user.Email = email
+	user.EmailVerified = false
+}
+
+// reserveEmail claims the address for an account which is about to be
+// created, so of two registrations with it only one gets that far.
+// registerEmail hands the claim over to the new account, releaseEmail gives
+// it up when the registration fails.
+func (helper *DBHelper) reserveEmail(email string) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var claimed bool
+	claimed, helper.err = redis.Bool(redisConn.Do("HSETNX", "emails", strings.ToLower(email), ""))
+	if helper.err == nil && !claimed {
+		helper.err = ErrEmailTaken
+	}
+}
+
+func (helper *DBHelper) releaseEmail(email string) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	_, helper.err = redisConn.Do("HDEL", "emails", strings.ToLower(email))
+}
+
+func (helper *DBHelper) registerEmail(user *User, email string) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	redisConn.Send("MULTI")
+	redisConn.Send("HSET", "emails", strings.ToLower(email), user.UserId)
+	redisConn.Send("HMSET", "user:"+user.UserId, "email", email, "emailVerified", false)
+	_, helper.err = redisConn.Do("EXEC")
+	if helper.err != nil {
+		return
+	}
+	user.Email = email
+	user.EmailVerified = false
+}
+
+// setPassword also bumps the session version, which signs out every other
+// session of the user.
+func (helper *DBHelper) setPassword(userId string, password string) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	redisConn.Send("MULTI")
+	redisConn.Send("HSET", "user:"+userId, "password", password)
+	redisConn.Send("HINCRBY", "user:"+userId, "sessionVersion", 1)
+	_, helper.err = redisConn.Do("EXEC")
+}
+
+// createToken stores a single-use token of the given kind which expires after
+// ttl seconds.
+func (helper *DBHelper) createToken(kind string, value string, ttl int) string {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	token := randomToken(32)
+	_, helper.err = redisConn.Do("SET", kind+":"+hashToken(token), value, "EX", ttl)
+	return token
+}
+
+func (helper *DBHelper) peekToken(kind string, token string) string {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var value string
+	value, helper.err = redis.String(redisConn.Do("GET", kind+":"+hashToken(token)))
+	return value
+}
+
+func (helper *DBHelper) takeToken(kind string, token string) string {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	key := kind + ":" + hashToken(token)
+	redisConn.Send("MULTI")
+	redisConn.Send("GET", key)
+	redisConn.Send("DEL", key)
+
+	var values []interface{}
+	values, helper.err = redis.Values(redisConn.Do("EXEC"))
+	if helper.err != nil {
+		return ""
+	}
+
+	var value string
+	value, helper.err = redis.String(values[0], nil)
+	return value
+}
+
+// Account Handlers
+
+func settingsHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	templateParams := map[string]interface{}{}
+	templateParams["user"] = user
+	templateParams["csrf"] = csrfToken(user.UserId, "settings")
+	templateParams["deletion"] = helper.getDeletion(user.UserId)
+
+	tmplRender.HTML(w, http.StatusOK, "settings", templateParams)
+}
+
+func emailHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	if !checkCSRF(r, user.UserId, "settings") {
+		Goback(w, r, errors.New("Your session has expired, please reload the page."))
+		return
+	}
+
+	email, err := parseEmail(r.PostFormValue("email"))
+	if err != nil {
+		Goback(w, r, err)
+		return
+	}
+
+	helper.setEmail(user, email)
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+
+	if !user.EmailVerified {
+		helper.sendVerification(user)
+		if helper.err != nil {
+			log.Printf("err in send verification mail %v", helper.err)
+		}
+	}
+
+	http.Redirect(w, r, "/settings", http.StatusFound)
+}
+
+func changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	if !checkCSRF(r, user.UserId, "settings") {
+		Goback(w, r, errors.New("Your session has expired, please reload the page."))
+		return
+	}
+
+	oldPassword := r.PostFormValue("old")
+	password := r.PostFormValue("password")
+	passwordVerify := r.PostFormValue("password2")
+
+	if password == "" || passwordVerify == "" {
+		Goback(w, r, errors.New("Every field of the form is needed!"))
+		return
+	}
+
+	if password != passwordVerify {
+		Goback(w, r, errors.New("The two password fileds don't match!"))
+		return
+	}
+
+	if err := checkPassword(password, user.UserName); err != nil {
+		Goback(w, r, err)
+		return
+	}
+
+	// Accounts created through an identity provider have no password yet.
+	if user.Password != "" {
+		old, err := encryptedPassword(oldPassword)
+		if err != nil {
+			Goback(w, r, err)
+			return
+		}
+		if old != user.Password {
+			Goback(w, r, errors.New("Your current password is wrong."))
+			return
+		}
+	}
+
+	password, err := encryptedPassword(password)
+	if err != nil {
+		Goback(w, r, err)
+		return
+	}
+
+	helper.setPassword(user.UserId, password)
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+
+	// Keep the current session under a new id, every other one is signed out.
+	helper.revokeOtherSessions(user.UserId, getSessionId(r))
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+	setSession(user.UserId, rememberedSession(r), r, w)
+
+	templateParams := map[string]interface{}{}
+	templateParams["user"] = user
+	templateParams["message"] = "Your password has been changed."
+	templateParams["csrf"] = csrfToken(user.UserId, "settings")
+	tmplRender.HTML(w, http.StatusOK, "settings", templateParams)
+}
+
+func forgotHandler(w http.ResponseWriter, r *http.Request) {
+	tmplRender.HTML(w, http.StatusOK, "forgot", map[string]interface{}{})
+}
+
+func sendResetHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+
+	email, err := parseEmail(r.PostFormValue("email"))
+	if err != nil {
+		Goback(w, r, err)
+		return
+	}
+
+	// Whether the address belongs to an account is never shown.
+	user := helper.getUserFromEmail(email)
+	if user != nil {
+		token := helper.createToken("reset", user.UserId, resetTokenTTL)
+		if helper.err == nil {
+			err = mailer.Send(&Mail{
+				To:      user.Email,
+				Subject: "Reset your SimpleGo password",
+				Body: "Hi " + user.UserName + ",\r\n\r\n" +
+					"somebody asked to reset the password of your account. If it was you, open\r\n" +
+					"the link below within an hour to choose a new password:\r\n\r\n" +
+					strings.TrimRight(*baseURL, "/") + "/reset?token=" + token + "\r\n\r\n" +
+					"Otherwise you can ignore this mail.\r\n",
+			})
+		}
+		if helper.err != nil || err != nil {
+			log.Printf("err in send reset mail %v %v", helper.err, err)
+		}
+	}
+
+	templateParams := map[string]interface{}{}
+	templateParams["sent"] = true
+	tmplRender.HTML(w, http.StatusOK, "forgot", templateParams)
+}
+
+func resetHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	token := r.FormValue("token")
+
+	helper.peekToken("reset", token)
+	if helper.err != nil {
+		Goback(w, r, errors.New("The reset link is invalid or has expired."))
+		return
+	}
+
+	templateParams := map[string]interface{}{}
+	templateParams["token"] = token
+	tmplRender.HTML(w, http.StatusOK, "reset", templateParams)
+}
+
+func resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+
+	password := r.PostFormValue("password")
+	passwordVerify := r.PostFormValue("password2")
+
+	if password == "" || passwordVerify == "" {
+		Goback(w, r, errors.New("Every field of the form is needed!"))
+		return
+	}
+
+	if password != passwordVerify {
+		Goback(w, r, errors.New("The two password fileds don't match!"))
+		return
+	}
+
+	// The link stays valid when the password is refused.
+	user := helper.loadUserInfo(helper.peekToken("reset", r.PostFormValue("token")))
+	if user == nil {
+		Goback(w, r, errors.New("The reset link is invalid or has expired."))
+		return
+	}
+
+	if err := checkPassword(password, user.UserName); err != nil {
+		Goback(w, r, err)
+		return
+	}
+
+	password, err := encryptedPassword(password)
+	if err != nil {
+		Goback(w, r, err)
+		return
+	}
+
+	userId := helper.takeToken("reset", r.PostFormValue("token"))
+	if helper.err != nil {
+		Goback(w, r, errors.New("The reset link is invalid or has expired."))
+		return
+	}
+
+	helper.setPassword(userId, password)
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+
+	helper.revokeOtherSessions(userId, "")
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+
+	// The mailbox alone must not get past the second factor.
+	if user.NeedsSecondFactor() {
+		setPendingLogin(userId, "/", false, r, w)
+
+		templateParams := map[string]interface{}{}
+		templateParams["totp"] = user.HasTwoFactor()
+		templateParams["passkeys"] = user.HasPasskeys()
+		tmplRender.HTML(w, http.StatusOK, "twofactor", templateParams)
+		return
+	}
+
+	setSession(userId, false, r, w)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Admin commands are run from the command line instead of starting the
+// server, e.g. `simplego -redisServer=localhost:6379 grant-admin alice`.
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"grant-admin":  {"grant-admin <username>", grantAdminCommand},
+	"revoke-admin": {"revoke-admin <username>", revokeAdminCommand},
+	"reset-2fa":    {"reset-2fa <username>", resetTwoFactorCommand},
+
+	"migrate-usernames": {"migrate-usernames [-apply]", migrateUserNamesCommand},
+	"index-posts":       {"index-posts", indexPostsCommand},
+	"delete-user":       {"delete-user <username> [-now]", deleteUserCommand},
+	"cancel-deletion":   {"cancel-deletion <username>", cancelDeletionCommand},
+	"export-user":       {"export-user <username> <file.zip>", exportUserCommand},
+	"collect-media":     {"collect-media", collectMediaCommand},
+}
+
+func runCommand(args []string) error {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		usage := []string{}
+		for _, c := range commands {
+			usage = append(usage, "  "+c.usage)
+		}
+		sort.Strings(usage)
+		return fmt.Errorf("unknown command %q, the commands are:\n%s", args[0], strings.Join(usage, "\n"))
+	}
+
+	if err := cmd.run(args[1:]); err != nil {
+		return fmt.Errorf("%s: %v\nusage: %s", args[0], err, cmd.usage)
+	}
+	return nil
+}
+
+func commandUser(args []string) (*User, error) {
+	if len(args) != 1 {
+		return nil, errors.New("wrong number of arguments")
+	}
+
+	helper := DBHelper{}
+	user := helper.getUserFromName(args[0])
+	if user == nil {
+		return nil, fmt.Errorf("no user named %q", args[0])
+	}
+	return user, nil
+}
+
+func grantAdminCommand(args []string) error {
+	user, err := commandUser(args)
+	if err != nil {
+		return err
+	}
+
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	_, err = redisConn.Do("SADD", "admins", user.UserId)
+	if err != nil {
+		return err
+	}
+
+	// The user signs in again to get a session with the new privileges.
+	helper := DBHelper{}
+	helper.revokeOtherSessions(user.UserId, "")
+	return helper.err
+}
+
+func revokeAdminCommand(args []string) error {
+	user, err := commandUser(args)
+	if err != nil {
+		return err
+	}
+
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	_, err = redisConn.Do("SREM", "admins", user.UserId)
+	if err != nil {
+		return err
+	}
+
+	// The user signs in again to get a session with the new privileges.
+	helper := DBHelper{}
+	helper.revokeOtherSessions(user.UserId, "")
+	return helper.err
+}
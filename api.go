@@ -0,0 +1,179 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/context"
+)
+
+// JSON API. Every endpoint is guarded by scopeHandler which only lets
+// requests with a valid OAuth access token for the given scope through.
+
+var (
+	ErrEmptyPost  = &Error{"empty_post", 422, "Unprocessable Entity", "The post must have a body or attachments."}
+	ErrUnverified = &Error{"unverified_email", 403, "Forbidden", "The email address of the account must be verified before posting."}
+)
+
+type UserResource struct {
+	UserId    string `json:"userId"`
+	UserName  string `json:"userName"`
+	Followers int    `json:"followers"`
+	Following int    `json:"following"`
+}
+
+type PostsResource struct {
+	Posts []*Post `json:"posts"`
+	Next  int64   `json:"next,omitempty"`
+}
+
+type PostRequest struct {
+	Body        string               `json:"body"`
+	Attachments []*AttachmentRequest `json:"attachments"`
+	InReplyTo   string               `json:"inReplyTo"`
+	QuoteOf     string               `json:"quoteOf"`
+}
+
+func scopeHandler(scope string) func(http.Handler) http.Handler {
+
+	m := func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			helper := DBHelper{}
+			auth := r.Header.Get("Authorization")
+			if !strings.HasPrefix(auth, "Bearer ") {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="SimpleGo"`)
+				WriteError(w, ErrUnauthorized)
+				return
+			}
+
+			grant := helper.getGrant("oauth_access:", strings.TrimPrefix(auth, "Bearer "))
+			if grant == nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="SimpleGo", error="invalid_token"`)
+				WriteError(w, ErrUnauthorized)
+				return
+			}
+
+			if !hasScope(grant.Scope, scope) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="SimpleGo", error="insufficient_scope", scope="`+scope+`"`)
+				WriteError(w, ErrForbidden)
+				return
+			}
+
+			user := helper.loadUserInfo(grant.UserId)
+			if helper.err != nil {
+				WriteError(w, ErrUnauthorized)
+				return
+			}
+
+			context.Set(r, "user", user)
+			next.ServeHTTP(w, r)
+		}
+
+		return http.HandlerFunc(fn)
+	}
+
+	return m
+}
+
+// API Handlers
+
+func apiMeHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	resource := UserResource{
+		UserId:    user.UserId,
+		UserName:  user.UserName,
+		Followers: helper.getFollowers(user.UserId),
+		Following: helper.getFollowing(user.UserId),
+	}
+
+	tmplRender.JSON(w, http.StatusOK, Response{"ok", resource})
+}
+
+func apiPostsHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	start, err := strconv.ParseInt(r.FormValue("start"), 10, 64)
+	if err != nil || start < 0 {
+		start = 0
+	}
+
+	posts, rest := helper.getUserPosts(user.UserId, user.UserId, start, 20)
+	if helper.err != nil {
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	resource := PostsResource{Posts: posts}
+	if rest > 0 {
+		resource.Next = start + 20
+	}
+
+	tmplRender.JSON(w, http.StatusOK, Response{"ok", resource})
+}
+
+func apiMentionsHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	start, err := strconv.ParseInt(r.FormValue("start"), 10, 64)
+	if err != nil || start < 0 {
+		start = 0
+	}
+
+	posts, rest := helper.getMentionPosts(user.UserId, user.UserId, start, 20)
+	if helper.err != nil {
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	resource := PostsResource{Posts: posts}
+	if rest > 0 {
+		resource.Next = start + 20
+	}
+
+	tmplRender.JSON(w, http.StatusOK, Response{"ok", resource})
+}
+
+func apiCreatePostHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+	body := context.Get(r, "body").(*PostRequest)
+
+	if strings.TrimSpace(body.Body) == "" && len(body.Attachments) == 0 {
+		WriteError(w, ErrEmptyPost)
+		return
+	}
+
+	attachments, err := lookupAttachments(body.Attachments)
+	if err != nil {
+		WriteError(w, &Error{"invalid_attachments", 422, "Unprocessable Entity", err.Error()})
+		return
+	}
+
+	if !user.CanPost() {
+		WriteError(w, ErrUnverified)
+		return
+	}
+
+	helper.post(&Post{
+		UserId:      user.UserId,
+		Body:        body.Body,
+		Attachments: attachments,
+		InReplyTo:   body.InReplyTo,
+		QuoteOf:     body.QuoteOf,
+	})
+	if helper.err == ErrPostNotFound {
+		WriteError(w, &Error{"invalid_reference", 422, "Unprocessable Entity", "The post to reply to or to quote doesn't exist."})
+		return
+	}
+	if helper.err != nil {
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	tmplRender.JSON(w, http.StatusCreated, Response{"ok", nil})
+}
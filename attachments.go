@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"net/http"
+	"strings"
+)
+
+// Posts have up to maxAttachments images, kept as JSON in the attachments
+// field of post:<id>. The web form uploads them with the post, API clients
+// upload to /api/media first and attach the returned ids.
+
+const (
+	maxAttachments   = 4
+	altTextMaxLength = 1000
+)
+
+var (
+	attachmentImage = &imageKind{widths: []int{400, 1280}}
+
+	ErrTooManyAttachments = fmt.Errorf("A post can have at most %d images.", maxAttachments)
+	ErrAttachment         = errors.New("The image to attach doesn't exist, please upload it again.")
+)
+
+type Attachment struct {
+	Id        string `json:"id"`
+	Alt       string `json:"alt,omitempty"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	URL       string `json:"url,omitempty"`
+	Thumbnail string `json:"thumbnail,omitempty"`
+}
+
+type AttachmentRequest struct {
+	Id  string `json:"id"`
+	Alt string `json:"alt"`
+}
+
+func newAttachment(id string, alt string, size image.Point) *Attachment {
+	return &Attachment{
+		Id:        id,
+		Alt:       alt,
+		Width:     size.X,
+		Height:    size.Y,
+		URL:       imageURL(id, attachmentImage.widths[1]),
+		Thumbnail: imageURL(id, attachmentImage.widths[0]),
+	}
+}
+
+// encodeAttachments leaves out the URLs, they follow from the id.
+func encodeAttachments(attachments []*Attachment) string {
+	if len(attachments) == 0 {
+		return ""
+	}
+
+	stored := make([]Attachment, len(attachments))
+	for i, attachment := range attachments {
+		stored[i] = Attachment{Id: attachment.Id, Alt: attachment.Alt, Width: attachment.Width, Height: attachment.Height}
+	}
+	data, _ := json.Marshal(stored)
+	return string(data)
+}
+
+func parseAttachments(data string) []*Attachment {
+	if data == "" {
+		return nil
+	}
+
+	attachments := []*Attachment{}
+	if err := json.Unmarshal([]byte(data), &attachments); err != nil {
+		return nil
+	}
+	for i, attachment := range attachments {
+		attachments[i] = newAttachment(attachment.Id, attachment.Alt, image.Pt(attachment.Width, attachment.Height))
+	}
+	return attachments
+}
+
+// formAttachments stores the images uploaded as image0 to image3 with the
+// alt texts alt0 to alt3.
+func formAttachments(r *http.Request) ([]*Attachment, error) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		return nil, nil
+	}
+
+	attachments := []*Attachment{}
+	for i := 0; i < maxAttachments; i++ {
+		file, _, err := r.FormFile(fmt.Sprintf("image%d", i))
+		if err == http.ErrMissingFile {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		img, err := decodeImage(file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		alt, err := profileText(r.PostFormValue(fmt.Sprintf("alt%d", i)), "alt text", altTextMaxLength)
+		if err != nil {
+			return nil, err
+		}
+
+		id, size, err := storeImage(img, attachmentImage)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, newAttachment(id, alt, size))
+	}
+	return attachments, nil
+}
+
+// lookupAttachments checks that the uploads exist and reads their sizes.
+func lookupAttachments(requests []*AttachmentRequest) ([]*Attachment, error) {
+	if len(requests) > maxAttachments {
+		return nil, ErrTooManyAttachments
+	}
+
+	attachments := []*Attachment{}
+	for _, request := range requests {
+		if id, err := hex.DecodeString(request.Id); err != nil || len(id) != 32 {
+			return nil, ErrAttachment
+		}
+
+		alt, err := profileText(request.Alt, "alt text", altTextMaxLength)
+		if err != nil {
+			return nil, err
+		}
+
+		f, err := blobs.Open("/" + imagePath(request.Id, attachmentImage.widths[1]))
+		if err != nil {
+			return nil, ErrAttachment
+		}
+		config, _, err := image.DecodeConfig(f)
+		f.Close()
+		if err != nil {
+			return nil, ErrAttachment
+		}
+		attachments = append(attachments, newAttachment(request.Id, alt, image.Pt(config.Width, config.Height)))
+	}
+	return attachments, nil
+}
+
+// Attachment Handlers
+
+func apiUploadMediaHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, *maxImageBytes+1<<20)
+
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		WriteError(w, &Error{"invalid_image", 400, "Bad Request", "The image must be uploaded as multipart/form-data in the image field."})
+		return
+	}
+	defer file.Close()
+
+	img, err := decodeImage(file)
+	if err != nil {
+		WriteError(w, &Error{"invalid_image", 422, "Unprocessable Entity", err.Error()})
+		return
+	}
+
+	id, size, err := storeImage(img, attachmentImage)
+	if err != nil {
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	tmplRender.JSON(w, http.StatusCreated, Response{"ok", newAttachment(id, "", size)})
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Uploaded images are kept in a BlobStore, only the ids are stored in Redis.
+// Blobs aren't reference counted: collectMedia marks the ids which avatars,
+// headers and attachments still use and removes the other blobs once they
+// are older than mediaGCGrace, which leaves time to attach an upload.
+
+var (
+	mediaGCInterval = flag.Duration("mediaGCInterval", 6*time.Hour, "how often unused uploads are removed")
+	mediaGCGrace    = flag.Duration("mediaGCGrace", 24*time.Hour, "how long an upload may stay unused before it is removed")
+
+	blobs BlobStore
+)
+
+const mediaGCLockTTL = 60 * 60
+
+// A BlobStore keeps immutable files by name. Names are slash separated
+// paths, Open makes the store usable with Static.
+type BlobStore interface {
+	http.FileSystem
+	// Put stores the data. A name which exists keeps its data but counts as
+	// new again, so the upload gets the whole grace period to be attached.
+	Put(name string, data []byte) error
+	Delete(name string) error
+	// Walk calls fn for every blob.
+	Walk(fn func(name string, modTime time.Time) error) error
+}
+
+// localBlobStore keeps the blobs as files below dir.
+type localBlobStore struct {
+	dir string
+	http.FileSystem
+}
+
+func newLocalBlobStore(dir string) BlobStore {
+	return &localBlobStore{dir, http.Dir(dir)}
+}
+
+func (s *localBlobStore) path(name string) (string, error) {
+	name = filepath.FromSlash(name)
+	if name != filepath.Clean(name) || filepath.IsAbs(name) || strings.HasPrefix(name, "..") {
+		return "", errors.New("invalid blob name " + name)
+	}
+	return filepath.Join(s.dir, name), nil
+}
+
+func (s *localBlobStore) Put(name string, data []byte) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	// The same image uploaded again must not be collected as the old
+	// unused upload. Chtimes fails when the collection just removed it.
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp" + randomToken(4)
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *localBlobStore) Delete(name string) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *localBlobStore) Walk(fn func(name string, modTime time.Time) error) error {
+	err := filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		name, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(name), info.ModTime())
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// blobId is the image id of a blob named <id[:2]>/<id>_<width>.jpg.
+func blobId(name string) string {
+	name = name[strings.LastIndex(name, "/")+1:]
+	if i := strings.IndexAny(name, "_."); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// usedMedia returns the ids of every image which is still referenced.
+func (helper *DBHelper) usedMedia() map[string]bool {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	used := map[string]bool{}
+	for _, scan := range []struct {
+		pattern string
+		fields  []string
+	}{
+		{"user:*", []string{"avatar", "header"}},
+		{"post:*", []string{"attachments"}},
+	} {
+		cursor := "0"
+		for {
+			var values []interface{}
+			values, helper.err = redis.Values(redisConn.Do("SCAN", cursor, "MATCH", scan.pattern, "COUNT", 1000))
+			if helper.err != nil {
+				return nil
+			}
+
+			var keys []string
+			cursor, _ = redis.String(values[0], nil)
+			keys, helper.err = redis.Strings(values[1], nil)
+			if helper.err != nil {
+				return nil
+			}
+
+			for _, key := range keys {
+				var fields []string
+				fields, helper.err = redis.Strings(redisConn.Do("HMGET", redis.Args{}.Add(key).AddFlat(scan.fields)...))
+				if helper.err != nil {
+					return nil
+				}
+				for i, field := range scan.fields {
+					if field == "attachments" {
+						for _, attachment := range parseAttachments(fields[i]) {
+							used[attachment.Id] = true
+						}
+					} else if fields[i] != "" {
+						used[fields[i]] = true
+					}
+				}
+			}
+
+			if cursor == "0" {
+				break
+			}
+		}
+	}
+	return used
+}
+
+// collectMedia removes the blobs nothing refers to and returns how many.
+func (helper *DBHelper) collectMedia() int {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	// Several servers can share the store, one collection at a time is
+	// enough.
+	token := helper.lock(redisConn, "media_gc_lock", mediaGCLockTTL)
+	if token == "" {
+		return 0
+	}
+	defer unlock(redisConn, "media_gc_lock", token)
+
+	// Blobs must be older than the grace period when the marking starts,
+	// uploads attached meanwhile are newer.
+	before := time.Now().Add(-*mediaGCGrace)
+	used := helper.usedMedia()
+	if helper.err != nil {
+		return 0
+	}
+
+	removed := 0
+	helper.err = blobs.Walk(func(name string, modTime time.Time) error {
+		if used[blobId(name)] || modTime.After(before) {
+			return nil
+		}
+		if err := blobs.Delete(name); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed
+}
+
+// runMediaGC is the background worker, it runs until the server stops.
+func runMediaGC() {
+	for {
+		helper := DBHelper{}
+		removed := helper.collectMedia()
+		if helper.err != nil {
+			log.Printf("err in media gc %v", helper.err)
+		} else if removed > 0 {
+			log.Printf("removed %d unused media files", removed)
+		}
+		time.Sleep(*mediaGCInterval)
+	}
+}
+
+func collectMediaCommand(args []string) error {
+	if len(args) != 0 {
+		return errors.New("wrong number of arguments")
+	}
+
+	helper := DBHelper{}
+	removed := helper.collectMedia()
+	if helper.err != nil {
+		return helper.err
+	}
+	log.Printf("removed %d unused media files", removed)
+	return nil
+}
@@ -11,6 +11,23 @@ import (
 var (
 	authKey    = []byte("y@b(@+fab&^PFnG$yJ5%^5TWgJt3OigHYYcb!J6(2@$UUK1S@9iajQAAL2y4Ou*=")
 	encryptKey = []byte("xKB(nJhIQvc(45%*ZO!#h0KjMW!VM=$!")
+
+	// unlockScript only deletes a lock still holding the token of its owner,
+	// one whose TTL ran out may belong to another worker by now.
+	unlockScript = redis.NewScript(1, `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+	// renewLockScript extends a lock the same way.
+	renewLockScript = redis.NewScript(1, `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('EXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
 )
 
 func NewPool(server string) *redis.Pool {
@@ -33,11 +50,34 @@ func NewPool(server string) *redis.Pool {
 	}
 }
 
+// lock takes the lock for ttl seconds and returns the token to release it
+// with, empty when another worker holds the lock.
+func (helper *DBHelper) lock(redisConn redis.Conn, key string, ttl int) string {
+	token := randomToken(16)
+
+	var reply interface{}
+	reply, helper.err = redisConn.Do("SET", key, token, "NX", "EX", ttl)
+	if helper.err != nil || reply == nil {
+		return ""
+	}
+	return token
+}
+
+func unlock(redisConn redis.Conn, key string, token string) {
+	if _, err := unlockScript.Do(redisConn, key, token); err != nil {
+		log.Printf("err in unlock %s %v", key, err)
+	}
+}
+
 func NewRedisStore(pool *redis.Pool) *redistore.RediStore {
 	redisStore, err := redistore.NewRediStoreWithPool(pool, authKey, encryptKey)
 	if err != nil {
 		log.Fatal("err in init redis store")
 		return nil
 	}
+
+	// SetMaxAge also makes the cookie codecs accept the longer lifetime.
+	redisStore.SetMaxAge(int(sessionLifetime.Seconds()))
+	redisStore.Options = sessionOptions()
 	return redisStore
 }
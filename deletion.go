@@ -0,0 +1,585 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/context"
+)
+
+// Deleting an account is a background job. deletion:<userId> holds the
+// request and how far the job got, the deletions sorted set has every job
+// scored by the time it is due. Until then the deletion can be cancelled,
+// afterwards runDeletions works through deletionSteps and picks up where it
+// stopped after a restart.
+//
+// Posts are found through the user_posts:<userId> list of the posts the user
+// wrote, index-posts builds it for posts written before it existed.
+
+var (
+	deletionGracePeriod = flag.Duration("deletionGracePeriod", 14*24*time.Hour, "how long the deletion of an account can be cancelled")
+
+	ErrDeletionRunning = errors.New("The account is already being deleted.")
+)
+
+const (
+	deletionLockTTL  = 10 * 60
+	deletionInterval = time.Minute
+	deletionBatch    = 100
+)
+
+type Deletion struct {
+	UserId    string `redis:"userId"`
+	Requested int64  `redis:"requested"`
+	Due       int64  `redis:"due"`
+	By        string `redis:"by"`
+	Step      int    `redis:"step"`
+	Cursor    string `redis:"cursor"`
+}
+
+func (d *Deletion) DueTime() string {
+	return time.Unix(d.Due, 0).UTC().Format("January 2, 2006 15:04 MST")
+}
+
+// A deletion step runs until it reports done, cursor lets it work through
+// large data in batches. Every step must be safe to run again.
+type deletionStep struct {
+	name string
+	run  func(helper *DBHelper, userId string, cursor string) (string, bool)
+}
+
+var (
+	deletionSteps = []deletionStep{
+		{"account", (*DBHelper).purgeAccount},
+		{"follows", (*DBHelper).purgeFollows},
+		{"posts", (*DBHelper).purgePosts},
+		{"feeds", (*DBHelper).purgeFeeds},
+		{"likes", (*DBHelper).purgeLikes},
+		{"reactions", (*DBHelper).purgeReactions},
+		{"data", (*DBHelper).purgeUserData},
+	}
+
+	// filterListScript removes every member of the set from the list.
+	filterListScript = redis.NewScript(2, `
+local ids = redis.call('LRANGE', KEYS[1], 0, -1)
+for _, id in ipairs(ids) do
+	if redis.call('SISMEMBER', KEYS[2], id) == 1 then
+		redis.call('LREM', KEYS[1], 0, id)
+	end
+end
+return 1
+`)
+)
+
+func (helper *DBHelper) scheduleDeletion(userId string, by string, due time.Time) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	key := "deletion:" + userId
+	redisConn.Send("MULTI")
+	redisConn.Send("HSETNX", key, "requested", time.Now().Unix())
+	redisConn.Send("HSETNX", key, "step", 0)
+	redisConn.Send("HMSET", key, "userId", userId, "by", by, "due", due.Unix())
+	redisConn.Send("ZADD", "deletions", due.Unix(), userId)
+	_, helper.err = redisConn.Do("EXEC")
+}
+
+func (helper *DBHelper) getDeletion(userId string) *Deletion {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var values []interface{}
+	values, helper.err = redis.Values(redisConn.Do("HGETALL", "deletion:"+userId))
+	if helper.err != nil || len(values) == 0 {
+		return nil
+	}
+
+	deletion := &Deletion{}
+	helper.err = redis.ScanStruct(values, deletion)
+	if helper.err != nil {
+		return nil
+	}
+	return deletion
+}
+
+// lockDeletion keeps the worker and cancelDeletion from running at the same
+// time.
+func (helper *DBHelper) lockDeletion(userId string) bool {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var reply interface{}
+	reply, helper.err = redisConn.Do("SET", "deletion_lock:"+userId, 1, "NX", "EX", deletionLockTTL)
+	return helper.err == nil && reply != nil
+}
+
+func (helper *DBHelper) unlockDeletion(userId string) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	redisConn.Do("DEL", "deletion_lock:"+userId)
+}
+
+func (helper *DBHelper) cancelDeletion(userId string) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	if !helper.lockDeletion(userId) {
+		if helper.err == nil {
+			helper.err = ErrDeletionRunning
+		}
+		return
+	}
+	defer helper.unlockDeletion(userId)
+
+	deletion := helper.getDeletion(userId)
+	if deletion == nil {
+		return
+	}
+	if deletion.Step > 0 {
+		helper.err = ErrDeletionRunning
+		return
+	}
+
+	redisConn.Send("MULTI")
+	redisConn.Send("DEL", "deletion:"+userId)
+	redisConn.Send("ZREM", "deletions", userId)
+	_, helper.err = redisConn.Do("EXEC")
+}
+
+// runDeletions is the background worker, it runs until the server stops.
+func runDeletions() {
+	for {
+		helper := DBHelper{}
+		ran := helper.runDueDeletion()
+		if helper.err != nil {
+			log.Printf("err in delete account %v", helper.err)
+		}
+		if !ran || helper.err != nil {
+			time.Sleep(deletionInterval)
+		}
+	}
+}
+
+// runDueDeletion runs one deletion which is due and reports whether there was
+// one.
+func (helper *DBHelper) runDueDeletion() bool {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var userIds []string
+	userIds, helper.err = redis.Strings(redisConn.Do("ZRANGEBYSCORE", "deletions", "-inf", time.Now().Unix(), "LIMIT", 0, 10))
+	if helper.err != nil {
+		return false
+	}
+
+	for _, userId := range userIds {
+		if !helper.lockDeletion(userId) {
+			continue
+		}
+		helper.runDeletion(userId)
+		helper.unlockDeletion(userId)
+		return true
+	}
+	return false
+}
+
+func (helper *DBHelper) runDeletion(userId string) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	deletion := helper.getDeletion(userId)
+	if deletion == nil {
+		if helper.err == nil {
+			_, helper.err = redisConn.Do("ZREM", "deletions", userId)
+		}
+		return
+	}
+
+	for deletion.Step < len(deletionSteps) {
+		step := deletionSteps[deletion.Step]
+		cursor, done := step.run(helper, userId, deletion.Cursor)
+		if helper.err != nil {
+			log.Printf("err in deletion step %s of user %s", step.name, userId)
+			return
+		}
+
+		if done {
+			deletion.Step++
+			deletion.Cursor = ""
+		} else {
+			deletion.Cursor = cursor
+		}
+
+		redisConn.Send("MULTI")
+		redisConn.Send("HMSET", "deletion:"+userId, "step", deletion.Step, "cursor", deletion.Cursor)
+		redisConn.Send("EXPIRE", "deletion_lock:"+userId, deletionLockTTL)
+		_, helper.err = redisConn.Do("EXEC")
+		if helper.err != nil {
+			return
+		}
+	}
+
+	redisConn.Send("MULTI")
+	redisConn.Send("DEL", "deletion:"+userId)
+	redisConn.Send("ZREM", "deletions", userId)
+	_, helper.err = redisConn.Do("EXEC")
+	log.Printf("deleted user %s", userId)
+}
+
+// purgeAccount makes the account unreachable: the name, email address and
+// linked logins are released and every session is signed out.
+func (helper *DBHelper) purgeAccount(userId string, cursor string) (string, bool) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	user := helper.loadUserInfo(userId)
+	if helper.err == redis.ErrNil {
+		helper.err = nil
+		return "", true
+	}
+	if helper.err != nil {
+		return "", false
+	}
+
+	for _, name := range []string{user.UserName, userNameKey(user.UserName)} {
+		var owner string
+		owner, helper.err = redis.String(redisConn.Do("HGET", "users", name))
+		if helper.err == nil && owner == userId {
+			_, helper.err = redisConn.Do("HDEL", "users", name)
+		}
+		if helper.err != nil && helper.err != redis.ErrNil {
+			return "", false
+		}
+	}
+
+	var subjects map[string]string
+	subjects, helper.err = redis.StringMap(redisConn.Do("HGETALL", "oidc_subjects"))
+	if helper.err != nil {
+		return "", false
+	}
+
+	redisConn.Send("MULTI")
+	redisConn.Send("ZREM", "users_by_time", user.UserName)
+	redisConn.Send("SREM", "admins", userId)
+	if user.Email != "" {
+		redisConn.Send("HDEL", "emails", strings.ToLower(user.Email))
+	}
+	for subject, owner := range subjects {
+		if owner == userId {
+			redisConn.Send("HDEL", "oidc_subjects", subject)
+		}
+	}
+	_, helper.err = redisConn.Do("EXEC")
+	if helper.err != nil {
+		return "", false
+	}
+
+	helper.revokeOtherSessions(userId, "")
+	if helper.err != nil {
+		return "", false
+	}
+	helper.deletePasskeys(userId)
+	return "", helper.err == nil
+}
+
+func (helper *DBHelper) purgeFollows(userId string, cursor string) (string, bool) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var followers, following []string
+	followers, helper.err = redis.Strings(redisConn.Do("ZRANGE", "followers:"+userId, 0, -1))
+	if helper.err != nil {
+		return "", false
+	}
+	following, helper.err = redis.Strings(redisConn.Do("ZRANGE", "following:"+userId, 0, -1))
+	if helper.err != nil {
+		return "", false
+	}
+
+	redisConn.Send("MULTI")
+	for _, followerId := range followers {
+		redisConn.Send("ZREM", "following:"+followerId, userId)
+	}
+	for _, followingId := range following {
+		redisConn.Send("ZREM", "followers:"+followingId, userId)
+	}
+	redisConn.Send("DEL", "followers:"+userId, "following:"+userId)
+	_, helper.err = redisConn.Do("EXEC")
+	return "", helper.err == nil
+}
+
+// purgePosts collects the posts of the user in deletion_posts:<userId> for
+// the next steps and takes them off the global timeline.
+func (helper *DBHelper) purgePosts(userId string, cursor string) (string, bool) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var postIds []string
+	postIds, helper.err = redis.Strings(redisConn.Do("LRANGE", "user_posts:"+userId, 0, -1))
+	if helper.err != nil || len(postIds) == 0 {
+		return "", helper.err == nil
+	}
+
+	_, helper.err = redisConn.Do("SADD", redis.Args{}.Add("deletion_posts:"+userId).AddFlat(postIds)...)
+	if helper.err != nil {
+		return "", false
+	}
+
+	_, helper.err = filterListScript.Do(redisConn, "timeline", "deletion_posts:"+userId)
+	return "", helper.err == nil
+}
+
+// purgeFeeds removes the posts from the home page of every user, a batch of
+// posts:* lists per call.
+func (helper *DBHelper) purgeFeeds(userId string, cursor string) (string, bool) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var exists bool
+	exists, helper.err = redis.Bool(redisConn.Do("EXISTS", "deletion_posts:"+userId))
+	if helper.err != nil || !exists {
+		return "", helper.err == nil
+	}
+
+	if cursor == "" {
+		cursor = "0"
+	}
+
+	var values []interface{}
+	values, helper.err = redis.Values(redisConn.Do("SCAN", cursor, "MATCH", "posts:*", "COUNT", deletionBatch))
+	if helper.err != nil {
+		return cursor, false
+	}
+
+	var keys []string
+	cursor, _ = redis.String(values[0], nil)
+	keys, helper.err = redis.Strings(values[1], nil)
+	if helper.err != nil {
+		return cursor, false
+	}
+
+	for _, key := range keys {
+		_, helper.err = filterListScript.Do(redisConn, key, "deletion_posts:"+userId)
+		if helper.err != nil {
+			return cursor, false
+		}
+	}
+	return cursor, cursor == "0"
+}
+
+// purgeUserData deletes the posts and whatever else is left of the user.
+func (helper *DBHelper) purgeUserData(userId string, cursor string) (string, bool) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var postIds, clientIds, codes []string
+	postIds, helper.err = redis.Strings(redisConn.Do("SMEMBERS", "deletion_posts:"+userId))
+	if helper.err != nil {
+		return "", false
+	}
+	clientIds, helper.err = redis.Strings(redisConn.Do("SMEMBERS", "oauth_clients:"+userId))
+	if helper.err != nil {
+		return "", false
+	}
+	codes, helper.err = redis.Strings(redisConn.Do("SMEMBERS", "invites:"+userId))
+	if helper.err != nil {
+		return "", false
+	}
+
+	parents := make([]string, len(postIds))
+	mentioned := make([][]string, len(postIds))
+	tags := make([][]string, len(postIds))
+	reposts := make([]map[string]string, len(postIds))
+	for i, postId := range postIds {
+		var links []string
+		links, helper.err = redis.Strings(redisConn.Do("HMGET", "post:"+postId, "inReplyTo", "repostOf", "mentions", "tags"))
+		if helper.err != nil {
+			return "", false
+		}
+		parents[i] = links[0]
+		mentioned[i] = mentionIds(parseMentions(links[2]))
+		tags[i] = parseTags(links[3])
+		// Like deletePost, the reposts of others go with the post.
+		reposts[i], helper.err = redis.StringMap(redisConn.Do("HGETALL", "reposts:"+postId))
+		if helper.err != nil {
+			return "", false
+		}
+		helper.forgetLikes(postId)
+		if helper.err != nil {
+			return "", false
+		}
+		helper.forgetReactions(postId)
+		if helper.err != nil {
+			return "", false
+		}
+		if links[1] != "" {
+			helper.forgetRepost(&Post{Id: postId, UserId: userId, RepostOf: links[1]})
+			if helper.err != nil {
+				return "", false
+			}
+		}
+	}
+
+	redisConn.Send("MULTI")
+	for i, postId := range postIds {
+		redisConn.Send("DEL", "post:"+postId, "post_history:"+postId, "replies:"+postId,
+			"reposts:"+postId, "delivered:"+postId)
+		if parents[i] != "" {
+			redisConn.Send("ZREM", "replies:"+parents[i], postId)
+		}
+		for _, mentionedId := range mentioned[i] {
+			redisConn.Send("LREM", "mentions:"+mentionedId, 0, postId)
+		}
+		for _, key := range tags[i] {
+			redisConn.Send("ZREM", "tag:"+key, postId)
+		}
+		for reposterId, repostId := range reposts[i] {
+			redisConn.Send("DEL", "post:"+repostId)
+			redisConn.Send("LREM", "user_posts:"+reposterId, 0, repostId)
+			redisConn.Send("SADD", "deleted_posts", repostId)
+		}
+	}
+	for _, clientId := range clientIds {
+		redisConn.Send("DEL", "oauth_client:"+clientId)
+	}
+	for _, code := range codes {
+		redisConn.Send("DEL", "invite:"+code)
+	}
+	redisConn.Send("DEL",
+		"user:"+userId, "posts:"+userId, "user_posts:"+userId, "deletion_posts:"+userId,
+		"oauth_clients:"+userId, "invites:"+userId, "sessions:"+userId,
+		"notifications:"+userId, "notifications_unread:"+userId, "mentions:"+userId,
+		"login_history:"+userId, "known_devices:"+userId, "export:"+userId,
+		"recovery_codes:"+userId, "totp_last:"+userId, "totp_pending:"+userId,
+	)
+	_, helper.err = redisConn.Do("EXEC")
+	return "", helper.err == nil
+}
+
+// indexPostsCommand builds user_posts:<userId> from the posts written before
+// the index existed.
+func indexPostsCommand(args []string) error {
+	if len(args) != 0 {
+		return errors.New("wrong number of arguments")
+	}
+
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	lastId, err := redis.Int(redisConn.Do("GET", "next_post_id"))
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+
+	byUser := map[string][]interface{}{}
+	for postId := 1; postId <= lastId; postId++ {
+		userId, err := redis.String(redisConn.Do("HGET", "post:"+strconv.Itoa(postId), "userId"))
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		byUser[userId] = append(byUser[userId], postId)
+	}
+
+	for userId, postIds := range byUser {
+		redisConn.Send("MULTI")
+		redisConn.Send("DEL", "user_posts:"+userId)
+		redisConn.Send("LPUSH", redis.Args{}.Add("user_posts:"+userId).Add(postIds...)...)
+		if _, err := redisConn.Do("EXEC"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteUserCommand(args []string) error {
+	now := len(args) == 2 && args[1] == "-now"
+	if now {
+		args = args[:1]
+	}
+
+	user, err := commandUser(args)
+	if err != nil {
+		return err
+	}
+
+	due := time.Now().Add(*deletionGracePeriod)
+	if now {
+		due = time.Now()
+	}
+
+	helper := DBHelper{}
+	helper.scheduleDeletion(user.UserId, "admin", due)
+	return helper.err
+}
+
+func cancelDeletionCommand(args []string) error {
+	user, err := commandUser(args)
+	if err != nil {
+		return err
+	}
+
+	helper := DBHelper{}
+	helper.cancelDeletion(user.UserId)
+	return helper.err
+}
+
+// Deletion Handlers
+
+func deleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	if !checkCSRF(r, user.UserId, "settings") {
+		Goback(w, r, errors.New("Your session has expired, please reload the page."))
+		return
+	}
+
+	// Accounts created through an identity provider have no password.
+	if user.Password != "" {
+		password, err := encryptedPassword(r.PostFormValue("password"))
+		if err != nil {
+			Goback(w, r, err)
+			return
+		}
+		if password != user.Password {
+			Goback(w, r, errors.New("Your password is wrong."))
+			return
+		}
+	}
+
+	helper.scheduleDeletion(user.UserId, "user", time.Now().Add(*deletionGracePeriod))
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+
+	http.Redirect(w, r, "/settings", http.StatusFound)
+}
+
+func cancelDeletionHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	if !checkCSRF(r, user.UserId, "settings") {
+		Goback(w, r, errors.New("Your session has expired, please reload the page."))
+		return
+	}
+
+	helper.cancelDeletion(user.UserId)
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+
+	http.Redirect(w, r, "/settings", http.StatusFound)
+}
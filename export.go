@@ -0,0 +1,496 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/context"
+)
+
+// A data export is a ZIP of JSON files with everything stored about a user,
+// built by writeExport for the "request my data" page as well as for the
+// export-user command. Requests wait in the export_queue list for
+// runExports, export:<userId> tracks the state and the download token of the
+// archive, which is kept in exportDir until exportTTL is over.
+
+var (
+	exportDir = flag.String("exportDir", "exports", "directory the data export archives are written to")
+	exportTTL = flag.Duration("exportTTL", 48*time.Hour, "how long a data export can be downloaded")
+
+	ErrExportExpired = errors.New("The download link is invalid or has expired, please request a new export.")
+)
+
+const exportQueueTimeout = 30
+
+type Export struct {
+	Status    string `redis:"status"`
+	Requested int64  `redis:"requested"`
+	Expires   int64  `redis:"expires"`
+	File      string `redis:"file"`
+	Token     string `redis:"token"`
+}
+
+func (e *Export) Ready() bool {
+	return e.Status == "ready"
+}
+
+func (e *Export) ExpiresTime() string {
+	return time.Unix(e.Expires, 0).UTC().Format("January 2, 2006 15:04 MST")
+}
+
+type ExportProfile struct {
+	UserId        string `json:"userId"`
+	UserName      string `json:"userName"`
+	DisplayName   string `json:"displayName,omitempty"`
+	Bio           string `json:"bio,omitempty"`
+	Location      string `json:"location,omitempty"`
+	Website       string `json:"website,omitempty"`
+	Avatar        string `json:"avatar,omitempty"`
+	Header        string `json:"header,omitempty"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified bool   `json:"emailVerified"`
+	Registered    string `json:"registered,omitempty"`
+	InvitedBy     string `json:"invitedBy,omitempty"`
+	TwoFactor     bool   `json:"twoFactor"`
+	Admin         bool   `json:"admin"`
+}
+
+type ExportPost struct {
+	PostId      string         `json:"postId"`
+	Time        string         `json:"time"`
+	Body        string         `json:"body"`
+	Edited      string         `json:"edited,omitempty"`
+	InReplyTo   string         `json:"inReplyTo,omitempty"`
+	RepostOf    string         `json:"repostOf,omitempty"`
+	QuoteOf     string         `json:"quoteOf,omitempty"`
+	History     []*PostVersion `json:"history,omitempty"`
+	Attachments []*Attachment  `json:"attachments,omitempty"`
+}
+
+type ExportUser struct {
+	UserId   string `json:"userId"`
+	UserName string `json:"userName,omitempty"`
+	Since    string `json:"since"`
+}
+
+// ExportSession leaves out the session id, the archive must not be enough to
+// take over a session.
+type ExportSession struct {
+	Device    string `json:"device"`
+	UserAgent string `json:"userAgent"`
+	IP        string `json:"ip"`
+	Created   string `json:"created"`
+	LastSeen  string `json:"lastSeen"`
+}
+
+type ExportPasskey struct {
+	Name     string `json:"name"`
+	Created  string `json:"created"`
+	LastUsed string `json:"lastUsed,omitempty"`
+}
+
+type ExportApplication struct {
+	ClientId    string `json:"clientId"`
+	Name        string `json:"name"`
+	RedirectURI string `json:"redirectUri"`
+}
+
+// An export file is one JSON file of the archive. New kinds of data get
+// their own file here.
+type exportFile struct {
+	name string
+	data func(helper *DBHelper, user *User) interface{}
+}
+
+var exportFiles = []exportFile{
+	{"profile.json", (*DBHelper).exportProfile},
+	{"posts.json", (*DBHelper).exportPosts},
+	{"likes.json", (*DBHelper).exportLikes},
+	{"reactions.json", (*DBHelper).exportReactions},
+	{"followers.json", (*DBHelper).exportFollowers},
+	{"following.json", (*DBHelper).exportFollowing},
+	{"sessions.json", (*DBHelper).exportSessions},
+	{"logins.json", (*DBHelper).exportLogins},
+	{"notifications.json", (*DBHelper).exportNotifications},
+	{"passkeys.json", (*DBHelper).exportPasskeys},
+	{"applications.json", (*DBHelper).exportApplications},
+}
+
+func exportTime(t int64) string {
+	if t == 0 {
+		return ""
+	}
+	return time.Unix(t, 0).UTC().Format(time.RFC3339)
+}
+
+func (helper *DBHelper) exportProfile(user *User) interface{} {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	profile := &ExportProfile{
+		UserId:        user.UserId,
+		UserName:      user.UserName,
+		DisplayName:   user.DisplayName,
+		Bio:           user.Bio,
+		Location:      user.Location,
+		Website:       user.Website,
+		Avatar:        storedImageURL(user.Avatar, 256),
+		Header:        storedImageURL(user.Header, 1500),
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		TwoFactor:     user.HasTwoFactor(),
+		Admin:         user.IsAdmin(),
+	}
+
+	registered, err := redis.Int64(redisConn.Do("ZSCORE", "users_by_time", user.UserName))
+	if err == nil {
+		profile.Registered = exportTime(registered)
+	}
+	profile.InvitedBy, _ = redis.String(redisConn.Do("HGET", "invited_by", user.UserId))
+	return profile
+}
+
+func (helper *DBHelper) exportPosts(user *User) interface{} {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var postIds []string
+	postIds, helper.err = redis.Strings(redisConn.Do("LRANGE", "user_posts:"+user.UserId, 0, -1))
+
+	posts := []*ExportPost{}
+	for _, postId := range postIds {
+		post := helper.getPost(postId)
+		if post.UserId == "" {
+			continue
+		}
+		exported := &ExportPost{
+			PostId:      postId,
+			Time:        exportTime(post.Posted),
+			Body:        post.Body,
+			Edited:      exportTime(post.Edited),
+			InReplyTo:   post.InReplyTo,
+			RepostOf:    post.RepostOf,
+			QuoteOf:     post.QuoteOf,
+			Attachments: post.Attachments,
+		}
+		if post.Edited > 0 {
+			exported.History = helper.getPostVersions(post)[1:]
+		}
+		posts = append(posts, exported)
+	}
+	return posts
+}
+
+func (helper *DBHelper) exportUsers(key string) []*ExportUser {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var values []string
+	values, helper.err = redis.Strings(redisConn.Do("ZRANGE", key, 0, -1, "WITHSCORES"))
+
+	users := []*ExportUser{}
+	for i := 0; i+1 < len(values); i += 2 {
+		since, _ := strconv.ParseInt(values[i+1], 10, 64)
+		userName, _ := redis.String(redisConn.Do("HGET", "user:"+values[i], "userName"))
+		users = append(users, &ExportUser{values[i], userName, exportTime(since)})
+	}
+	return users
+}
+
+func (helper *DBHelper) exportFollowers(user *User) interface{} {
+	return helper.exportUsers("followers:" + user.UserId)
+}
+
+func (helper *DBHelper) exportFollowing(user *User) interface{} {
+	return helper.exportUsers("following:" + user.UserId)
+}
+
+func (helper *DBHelper) exportSessions(user *User) interface{} {
+	sessions := []*ExportSession{}
+	for _, s := range helper.getSessions(user.UserId, "") {
+		sessions = append(sessions, &ExportSession{s.Device(), s.UserAgent, s.IP, exportTime(s.Created), exportTime(s.LastSeen)})
+	}
+	return sessions
+}
+
+func (helper *DBHelper) exportLogins(user *User) interface{} {
+	return helper.getLoginHistory(user.UserId)
+}
+
+func (helper *DBHelper) exportNotifications(user *User) interface{} {
+	notifications, _ := helper.getNotifications(user.UserId, 0, notificationsSize)
+	return notifications
+}
+
+func (helper *DBHelper) exportPasskeys(user *User) interface{} {
+	passkeys := []*ExportPasskey{}
+	for _, passkey := range helper.getPasskeys(user.UserId) {
+		passkeys = append(passkeys, &ExportPasskey{passkey.Name, exportTime(passkey.Created), exportTime(passkey.LastUsed)})
+	}
+	return passkeys
+}
+
+func (helper *DBHelper) exportApplications(user *User) interface{} {
+	applications := []*ExportApplication{}
+	for _, client := range helper.getUserClients(user.UserId) {
+		applications = append(applications, &ExportApplication{client.ClientId, client.Name, client.RedirectURI})
+	}
+	return applications
+}
+
+// writeExport writes the archive of the user to w.
+func (helper *DBHelper) writeExport(w io.Writer, user *User) {
+	archive := zip.NewWriter(w)
+
+	for _, file := range exportFiles {
+		data := file.data(helper, user)
+		if helper.err != nil {
+			return
+		}
+
+		var f io.Writer
+		f, helper.err = archive.CreateHeader(&zip.FileHeader{Name: file.name, Method: zip.Deflate, Modified: time.Now()})
+		if helper.err != nil {
+			return
+		}
+
+		encoder := json.NewEncoder(f)
+		encoder.SetIndent("", "  ")
+		helper.err = encoder.Encode(data)
+		if helper.err != nil {
+			return
+		}
+	}
+
+	helper.err = archive.Close()
+}
+
+func (helper *DBHelper) requestExport(userId string) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var created bool
+	created, helper.err = redis.Bool(redisConn.Do("HSETNX", "export:"+userId, "status", "pending"))
+	if helper.err != nil {
+		return
+	}
+	if !created {
+		// A pending export is not queued twice, a ready one is replaced.
+		var status string
+		status, helper.err = redis.String(redisConn.Do("HGET", "export:"+userId, "status"))
+		if helper.err != nil || status == "pending" {
+			return
+		}
+	}
+
+	redisConn.Send("MULTI")
+	redisConn.Send("DEL", "export:"+userId)
+	redisConn.Send("HMSET", "export:"+userId, "status", "pending", "requested", time.Now().Unix())
+	redisConn.Send("EXPIRE", "export:"+userId, int(exportTTL.Seconds()))
+	redisConn.Send("LPUSH", "export_queue", userId)
+	_, helper.err = redisConn.Do("EXEC")
+}
+
+func (helper *DBHelper) getExport(userId string) *Export {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var values []interface{}
+	values, helper.err = redis.Values(redisConn.Do("HGETALL", "export:"+userId))
+	if helper.err != nil || len(values) == 0 {
+		return nil
+	}
+
+	export := &Export{}
+	helper.err = redis.ScanStruct(values, export)
+	if helper.err != nil {
+		return nil
+	}
+	return export
+}
+
+// buildExport writes the archive of the user to exportDir and returns the
+// download token.
+func (helper *DBHelper) buildExport(userId string) string {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	user := helper.loadUserInfo(userId)
+	if user == nil {
+		return ""
+	}
+
+	helper.err = os.MkdirAll(*exportDir, 0700)
+	if helper.err != nil {
+		return ""
+	}
+
+	name := randomToken(16) + ".zip"
+	var file *os.File
+	file, helper.err = os.OpenFile(filepath.Join(*exportDir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if helper.err != nil {
+		return ""
+	}
+
+	helper.writeExport(file, user)
+	if err := file.Close(); helper.err == nil {
+		helper.err = err
+	}
+	if helper.err != nil {
+		os.Remove(file.Name())
+		return ""
+	}
+
+	token := randomToken(24)
+	expires := time.Now().Add(*exportTTL).Unix()
+	redisConn.Send("MULTI")
+	redisConn.Send("HMSET", "export:"+userId, "status", "ready", "file", name, "token", token, "expires", expires)
+	redisConn.Send("EXPIREAT", "export:"+userId, expires)
+	_, helper.err = redisConn.Do("EXEC")
+	return token
+}
+
+// removeOldExports deletes the archives which can't be downloaded anymore.
+func removeOldExports() {
+	files, err := filepath.Glob(filepath.Join(*exportDir, "*.zip"))
+	if err != nil {
+		return
+	}
+
+	for _, name := range files {
+		info, err := os.Stat(name)
+		if err == nil && time.Since(info.ModTime()) > *exportTTL {
+			os.Remove(name)
+		}
+	}
+}
+
+// runExports is the background worker, it runs until the server stops.
+func runExports() {
+	for {
+		redisConn := redisPool.Get()
+		reply, err := redis.Strings(redisConn.Do("BRPOP", "export_queue", exportQueueTimeout))
+		redisConn.Close()
+
+		if err == redis.ErrNil {
+			removeOldExports()
+			continue
+		}
+		if err != nil {
+			log.Printf("err in export queue %v", err)
+			time.Sleep(time.Minute)
+			continue
+		}
+
+		helper := DBHelper{}
+		userId := reply[1]
+		token := helper.buildExport(userId)
+		if token == "" {
+			log.Printf("err in export of user %s %v", userId, helper.err)
+			continue
+		}
+
+		helper.notify(userId, &Notification{
+			Kind: "export",
+			Text: "Your data export is ready to download",
+			Link: "/settings/export/download?token=" + token,
+		})
+		if helper.err != nil {
+			log.Printf("err in notify %v", helper.err)
+		}
+	}
+}
+
+func exportUserCommand(args []string) error {
+	if len(args) != 2 {
+		return errors.New("wrong number of arguments")
+	}
+
+	user, err := commandUser(args[:1])
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(args[1], os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	helper := DBHelper{}
+	helper.writeExport(file, user)
+	if err := file.Close(); helper.err == nil {
+		helper.err = err
+	}
+	return helper.err
+}
+
+// Export Handlers
+
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	templateParams := map[string]interface{}{}
+	templateParams["user"] = user
+	templateParams["csrf"] = csrfToken(user.UserId, "export")
+	templateParams["export"] = helper.getExport(user.UserId)
+	templateParams["ttl"] = int(exportTTL.Hours())
+
+	tmplRender.HTML(w, http.StatusOK, "export", templateParams)
+}
+
+func requestExportHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	if !checkCSRF(r, user.UserId, "export") {
+		Goback(w, r, errors.New("Your session has expired, please reload the page."))
+		return
+	}
+
+	helper.requestExport(user.UserId)
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+
+	http.Redirect(w, r, "/settings/export", http.StatusFound)
+}
+
+func downloadExportHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	export := helper.getExport(user.UserId)
+	if export == nil || !export.Ready() || export.Expires < time.Now().Unix() {
+		Goback(w, r, ErrExportExpired)
+		return
+	}
+	if !hmac.Equal([]byte(r.FormValue("token")), []byte(export.Token)) {
+		Goback(w, r, ErrExportExpired)
+		return
+	}
+
+	file, err := os.Open(filepath.Join(*exportDir, filepath.Base(export.File)))
+	if err != nil {
+		Goback(w, r, ErrExportExpired)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="simplego-data.zip"`)
+	w.Header().Set("Cache-Control", "no-store")
+	io.Copy(w, file)
+}
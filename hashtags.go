@@ -0,0 +1,223 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/context"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// The hashtags of a post are kept by their key in the tags field of
+// post:<id>, separated by spaces, and tag:<key> has the posts with the tag
+// scored by the post time. The key is the NFKC normalized, case folded tag,
+// so #Go, #go and #ｇｏ are the same tag, it is what the links and the tag
+// pages use.
+
+const (
+	maxTags      = 10
+	tagMaxLength = 50
+)
+
+// tagPattern matches #tag at the start of the body or after something which
+// can't be part of a tag, so URL fragments and "&#39;" don't count. The
+// combining marks belong to the letter before them, a decomposed "café" or
+// a Devanagari word is one tag.
+var tagPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{M}\p{N}_#&/])#([\p{L}\p{N}_][\p{L}\p{M}\p{N}_]*)`)
+
+// tagKey is what two hashtags must differ in, empty for something which
+// isn't a tag.
+func tagKey(tag string) string {
+	key := norm.NFKC.String(cases.Fold().String(norm.NFKC.String(tag)))
+	if key == "" || utf8.RuneCountInString(key) > tagMaxLength {
+		return ""
+	}
+	for i, c := range key {
+		if unicode.IsMark(c) && i > 0 {
+			continue
+		}
+		if c != '_' && !unicode.IsLetter(c) && !unicode.IsDigit(c) {
+			return ""
+		}
+	}
+	// #1 is a number, not a tag.
+	if strings.IndexFunc(key, func(c rune) bool { return !unicode.IsDigit(c) && !unicode.IsMark(c) }) < 0 {
+		return ""
+	}
+	return key
+}
+
+// findTags returns the keys of the hashtags in the body, every tag once.
+func findTags(body string) []string {
+	keys := []string{}
+	seen := map[string]bool{}
+	for _, match := range tagPattern.FindAllStringSubmatch(body, -1) {
+		key := tagKey(match[1])
+		if key == "" || seen[key] || len(keys) == maxTags {
+			continue
+		}
+		seen[key] = true
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func parseTags(data string) []string {
+	return strings.Fields(data)
+}
+
+func tagURL(key string) string {
+	return "/tag/" + url.PathEscape(key)
+}
+
+// tagLinks links the hashtags of the post to their pages.
+func (p *Post) tagLinks() []*bodyLink {
+	tagged := map[string]bool{}
+	for _, key := range p.Tags {
+		tagged[key] = true
+	}
+
+	links := []*bodyLink{}
+	for _, match := range tagPattern.FindAllStringSubmatchIndex(p.Body, -1) {
+		key := tagKey(p.Body[match[2]:match[3]])
+		if tagged[key] {
+			links = append(links, &bodyLink{match[2] - 1, match[3], "hashtag", tagURL(key)})
+		}
+	}
+	return links
+}
+
+// retag moves the post from the indexes of the tags it had to the ones of
+// the tags it has now, within the transaction of the caller.
+func retag(redisConn redis.Conn, post *Post, before []string, after []string) {
+	had := map[string]bool{}
+	for _, key := range before {
+		had[key] = true
+	}
+	has := map[string]bool{}
+	for _, key := range after {
+		has[key] = true
+		if !had[key] {
+			redisConn.Send("ZADD", "tag:"+key, post.Posted, post.Id)
+		}
+	}
+	for _, key := range before {
+		if !has[key] {
+			redisConn.Send("ZREM", "tag:"+key, post.Id)
+		}
+	}
+}
+
+// getTagPosts returns the posts with the tag, the latest first.
+func (helper *DBHelper) getTagPosts(key string, viewerId string, start int64, count int64) ([]*Post, int64) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var (
+		values []string
+		length int64
+	)
+	values, helper.err = redis.Strings(redisConn.Do("ZREVRANGE", "tag:"+key, start, start+count-1))
+	posts := []*Post{}
+
+	for _, postId := range values {
+		post := helper.getPost(postId)
+		if post.UserId == "" {
+			continue
+		}
+		post.Time = strElapsed(post.Time)
+		posts = append(posts, post)
+	}
+
+	length, helper.err = redis.Int64(redisConn.Do("ZCARD", "tag:"+key))
+	helper.loadPostStats(posts, viewerId)
+	if helper.err != nil {
+		return posts, 0
+	}
+	return posts, length - start - int64(len(values))
+}
+
+// tagParam returns the tag named in the route and its key.
+func tagParam(r *http.Request) (string, string) {
+	params := context.Get(r, "params").(httprouter.Params)
+	name := params.ByName("name")
+	return name, tagKey(name)
+}
+
+// Hashtag Handlers
+
+func tagHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+
+	name, key := tagParam(r)
+	if key == "" {
+		http.Redirect(w, r, "/timeline", http.StatusFound)
+		return
+	}
+	// Links always use the key, typed URLs end up there too.
+	if name != key {
+		http.Redirect(w, r, tagURL(key), http.StatusMovedPermanently)
+		return
+	}
+
+	start, err := strconv.ParseInt(r.FormValue("start"), 10, 64)
+	if err != nil || start < 0 {
+		start = 0
+	}
+
+	posts, rest := helper.getTagPosts(key, viewerId(r), start, 10)
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+
+	templateParams := map[string]interface{}{}
+	templateParams["user"] = context.Get(r, "user")
+	templateParams["tag"] = key
+	templateParams["posts"] = posts
+	templateParams["start"] = start
+	if start > 0 {
+		templateParams["prev"] = start - 10
+	}
+	if rest > 0 {
+		templateParams["next"] = start + 10
+	}
+
+	tmplRender.HTML(w, http.StatusOK, "tag", templateParams)
+}
+
+func apiTagHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+
+	_, key := tagParam(r)
+	if key == "" {
+		WriteError(w, ErrNotFound)
+		return
+	}
+
+	start, err := strconv.ParseInt(r.FormValue("start"), 10, 64)
+	if err != nil || start < 0 {
+		start = 0
+	}
+
+	posts, rest := helper.getTagPosts(key, viewerId(r), start, 20)
+	if helper.err != nil {
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	resource := PostsResource{Posts: posts}
+	if rest > 0 {
+		resource.Next = start + 20
+	}
+
+	tmplRender.JSON(w, http.StatusOK, Response{"ok", resource})
+}
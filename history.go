@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/context"
+)
+
+// Every login attempt on an existing account is kept in the capped
+// login_history:<userId> list as JSON. Browsers are told apart by a long
+// lived random cookie, the hashes of the ones which logged in before are in
+// the known_devices:<userId> set.
+
+const (
+	loginHistorySize = 50
+	deviceCookieName = "Device"
+	deviceCookieAge  = 86400 * 365 * 2
+)
+
+type LoginEvent struct {
+	Time      int64  `json:"time"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"userAgent"`
+	Method    string `json:"method"`
+	Success   bool   `json:"success"`
+}
+
+func (e *LoginEvent) Device() string {
+	return describeUserAgent(e.UserAgent)
+}
+
+func (e *LoginEvent) Elapsed() string {
+	return strElapsed(strconv.FormatInt(e.Time, 10))
+}
+
+func (helper *DBHelper) recordLogin(userId string, method string, success bool, r *http.Request) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	ua := r.UserAgent()
+	if len(ua) > 256 {
+		ua = ua[:256]
+	}
+
+	var data []byte
+	data, helper.err = json.Marshal(&LoginEvent{time.Now().Unix(), remoteIP(r), ua, method, success})
+	if helper.err != nil {
+		return
+	}
+
+	redisConn.Send("MULTI")
+	redisConn.Send("LPUSH", "login_history:"+userId, data)
+	redisConn.Send("LTRIM", "login_history:"+userId, 0, loginHistorySize-1)
+	_, helper.err = redisConn.Do("EXEC")
+}
+
+func (helper *DBHelper) getLoginHistory(userId string) []*LoginEvent {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var values [][]byte
+	values, helper.err = redis.ByteSlices(redisConn.Do("LRANGE", "login_history:"+userId, 0, -1))
+
+	events := []*LoginEvent{}
+	for _, value := range values {
+		event := &LoginEvent{}
+		if json.Unmarshal(value, event) == nil {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// deviceId returns the id of the browser, handing out a new one when it
+// doesn't have one yet.
+func deviceId(r *http.Request, w http.ResponseWriter) string {
+	if cookie, err := r.Cookie(deviceCookieName); err == nil && len(cookie.Value) == 22 {
+		return cookie.Value
+	}
+
+	id := randomToken(16)
+	options := sessionOptions()
+	http.SetCookie(w, &http.Cookie{
+		Name:     deviceCookieName,
+		Value:    id,
+		Path:     "/",
+		Domain:   options.Domain,
+		MaxAge:   deviceCookieAge,
+		Secure:   options.Secure,
+		HttpOnly: true,
+		SameSite: options.SameSite,
+	})
+	return id
+}
+
+// rememberDevice reports whether the device is new to an account which
+// logged in before, the very first device is never reported.
+func (helper *DBHelper) rememberDevice(userId string, device string) bool {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	redisConn.Send("MULTI")
+	redisConn.Send("SCARD", "known_devices:"+userId)
+	redisConn.Send("SADD", "known_devices:"+userId, hashToken(device))
+
+	var replies []interface{}
+	replies, helper.err = redis.Values(redisConn.Do("EXEC"))
+	if helper.err != nil {
+		return false
+	}
+
+	known, _ := redis.Int(replies[0], nil)
+	added, _ := redis.Int(replies[1], nil)
+	return known > 0 && added == 1
+}
+
+// alertNewDevice tells the user about a login from a new device in the app
+// and by mail.
+func (helper *DBHelper) alertNewDevice(user *User, r *http.Request) {
+	device := describeUserAgent(r.UserAgent())
+
+	helper.notify(user.UserId, &Notification{
+		Kind: "login",
+		Text: "New login from " + device + " (" + remoteIP(r) + ")",
+		Link: "/settings/security",
+	})
+	if helper.err != nil || user.Email == "" {
+		return
+	}
+
+	helper.err = mailer.Send(&Mail{
+		To:      user.Email,
+		Subject: "New login to your SimpleGo account",
+		Body: "Hi " + user.UserName + ",\r\n\r\n" +
+			"your account was just used to log in from a device we haven't seen before:\r\n\r\n" +
+			"  " + device + " from " + remoteIP(r) + " at " + time.Now().UTC().Format(time.RFC1123) + "\r\n\r\n" +
+			"If this was you, there is nothing to do. Otherwise change your password and\r\n" +
+			"sign out the other sessions at\r\n\r\n" +
+			strings.TrimRight(*baseURL, "/") + "/settings/sessions\r\n",
+	})
+}
+
+// loginSucceeded starts the session of a user who passed every factor and
+// records the login, method names how.
+func loginSucceeded(userId string, method string, remember bool, r *http.Request, w http.ResponseWriter) {
+	helper := DBHelper{}
+
+	setSession(userId, remember, r, w)
+
+	helper.recordLogin(userId, method, true, r)
+	if helper.err != nil {
+		log.Printf("err in record login %v", helper.err)
+	}
+
+	if !helper.rememberDevice(userId, deviceId(r, w)) {
+		return
+	}
+
+	user := helper.loadUserInfo(userId)
+	if user == nil {
+		log.Printf("err in load user %v", helper.err)
+		return
+	}
+	helper.alertNewDevice(user, r)
+	if helper.err != nil {
+		log.Printf("err in alert new device %v", helper.err)
+	}
+}
+
+func loginFailed(userId string, method string, r *http.Request) {
+	helper := DBHelper{}
+	helper.recordLogin(userId, method, false, r)
+	if helper.err != nil {
+		log.Printf("err in record login %v", helper.err)
+	}
+}
+
+// Security Handlers
+
+func securityHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	templateParams := map[string]interface{}{}
+	templateParams["user"] = user
+	templateParams["logins"] = helper.getLoginHistory(user.UserId)
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+
+	tmplRender.HTML(w, http.StatusOK, "security", templateParams)
+}
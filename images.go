@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/context"
+)
+
+// Uploaded images are decoded and encoded again as JPEG, which drops any
+// metadata such as the location a photo was taken at, then cropped and
+// scaled to the sizes of their kind. The files are named after the hash of
+// the image, <id[:2]>/<id>_<width>.jpg in the blob store, and served under
+// /media with long cache headers since they never change.
+
+var (
+	mediaDir      = flag.String("mediaDir", "media", "directory uploaded images are stored in")
+	maxImageBytes = flag.Int64("maxImageSize", 5<<20, "maximum size of an uploaded image in bytes")
+
+	ErrImageType  = errors.New("Please upload a JPEG, PNG or GIF image.")
+	ErrImageLarge = errors.New("The image is too large.")
+)
+
+const (
+	maxImagePixels = 40000000
+	jpegQuality    = 85
+)
+
+// An image kind has an aspect ratio and the widths it is stored in. Kinds
+// without an aspect ratio keep the one of the image and are never scaled up.
+type imageKind struct {
+	field  string
+	aspect [2]int
+	widths []int
+}
+
+var (
+	avatarImage = &imageKind{"avatar", [2]int{1, 1}, []int{48, 96, 256}}
+	headerImage = &imageKind{"header", [2]int{3, 1}, []int{600, 1500}}
+)
+
+// size returns the size of the image scaled from rect for the width.
+func (k *imageKind) size(rect image.Rectangle, width int) image.Point {
+	if k.aspect[0] > 0 {
+		return image.Pt(width, width*k.aspect[1]/k.aspect[0])
+	}
+	if width > rect.Dx() {
+		width = rect.Dx()
+	}
+	height := width * rect.Dy() / rect.Dx()
+	if height < 1 {
+		height = 1
+	}
+	return image.Pt(width, height)
+}
+
+func imagePath(id string, width int) string {
+	return fmt.Sprintf("%s/%s_%d.jpg", id[:2], id, width)
+}
+
+func imageURL(id string, width int) string {
+	return "/media/" + imagePath(id, width)
+}
+
+func (u *User) AvatarURL() string {
+	return avatarURL(u.Avatar, 96)
+}
+
+func (u *User) HeaderURL() string {
+	return storedImageURL(u.Header, 1500)
+}
+
+// avatarURL falls back to the default avatar for users without one.
+func avatarURL(id string, width int) string {
+	if id == "" {
+		return "/img/avatar.svg"
+	}
+	return imageURL(id, width)
+}
+
+func storedImageURL(id string, width int) string {
+	if id == "" {
+		return ""
+	}
+	return imageURL(id, width)
+}
+
+// decodeImage reads an upload of at most maxImageBytes. The type is sniffed
+// from the content and the dimensions are checked before decoding.
+func decodeImage(r io.Reader) (image.Image, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, *maxImageBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > *maxImageBytes {
+		return nil, ErrImageLarge
+	}
+
+	switch http.DetectContentType(data) {
+	case "image/jpeg", "image/png", "image/gif":
+	default:
+		return nil, ErrImageType
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrImageType
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxImagePixels {
+		return nil, ErrImageLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrImageType
+	}
+	return img, nil
+}
+
+// flatten draws the image on white, transparency can't be kept in a JPEG.
+func flatten(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), &image.Uniform{color.White}, image.ZP, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Over)
+	return dst
+}
+
+// crop returns the largest centered part of src with the aspect ratio.
+func crop(src *image.RGBA, aspect [2]int) image.Rectangle {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	if w*aspect[1] > h*aspect[0] {
+		cw := h * aspect[0] / aspect[1]
+		return image.Rect((w-cw)/2, 0, (w-cw)/2+cw, h)
+	}
+	ch := w * aspect[1] / aspect[0]
+	return image.Rect(0, (h-ch)/2, w, (h-ch)/2+ch)
+}
+
+// scale resizes the part of src to width x height, every pixel is the
+// average of the source pixels it covers.
+func scale(src *image.RGBA, rect image.Rectangle, width int, height int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	sw, sh := rect.Dx(), rect.Dy()
+
+	for y := 0; y < height; y++ {
+		y0 := rect.Min.Y + y*sh/height
+		y1 := rect.Min.Y + (y+1)*sh/height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+
+		for x := 0; x < width; x++ {
+			x0 := rect.Min.X + x*sw/width
+			x1 := rect.Min.X + (x+1)*sw/width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, n int
+			for sy := y0; sy < y1; sy++ {
+				i := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += int(src.Pix[i])
+					g += int(src.Pix[i+1])
+					b += int(src.Pix[i+2])
+					i += 4
+					n++
+				}
+			}
+
+			j := dst.PixOffset(x, y)
+			dst.Pix[j] = uint8(r / n)
+			dst.Pix[j+1] = uint8(g / n)
+			dst.Pix[j+2] = uint8(b / n)
+			dst.Pix[j+3] = 0xff
+		}
+	}
+	return dst
+}
+
+func encodeJPEG(img image.Image) ([]byte, error) {
+	var b bytes.Buffer
+	err := jpeg.Encode(&b, img, &jpeg.Options{Quality: jpegQuality})
+	return b.Bytes(), err
+}
+
+// storeImage puts every size of the image in the blob store and returns its
+// id and the size of the largest one.
+func storeImage(img image.Image, kind *imageKind) (string, image.Point, error) {
+	src := flatten(img)
+	rect := src.Bounds()
+	if kind.aspect[0] > 0 {
+		rect = crop(src, kind.aspect)
+	}
+
+	largest := kind.size(rect, kind.widths[len(kind.widths)-1])
+	full, err := encodeJPEG(scale(src, rect, largest.X, largest.Y))
+	if err != nil {
+		return "", largest, err
+	}
+	sum := sha256.Sum256(full)
+	id := hex.EncodeToString(sum[:])
+
+	for i, width := range kind.widths {
+		data := full
+		if i < len(kind.widths)-1 {
+			size := kind.size(rect, width)
+			data, err = encodeJPEG(scale(src, rect, size.X, size.Y))
+			if err != nil {
+				return "", largest, err
+			}
+		}
+		if err := blobs.Put(imagePath(id, width), data); err != nil {
+			return "", largest, err
+		}
+	}
+	return id, largest, nil
+}
+
+func (helper *DBHelper) setImage(userId string, kind *imageKind, id string) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	if id == "" {
+		_, helper.err = redisConn.Do("HDEL", "user:"+userId, kind.field)
+		return
+	}
+	_, helper.err = redisConn.Do("HSET", "user:"+userId, kind.field, id)
+}
+
+// Image Handlers
+
+func uploadImageHandler(kind *imageKind) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		helper := DBHelper{}
+		user := context.Get(r, "user").(*User)
+
+		// Leave room for the other fields of the form.
+		r.Body = http.MaxBytesReader(w, r.Body, *maxImageBytes+1<<20)
+		if !checkCSRF(r, user.UserId, "profile") {
+			Goback(w, r, errors.New("Your session has expired, please reload the page."))
+			return
+		}
+
+		id := ""
+		if r.PostFormValue("remove") == "" {
+			file, _, err := r.FormFile("image")
+			if err != nil {
+				Goback(w, r, errors.New("Please choose an image to upload."))
+				return
+			}
+			defer file.Close()
+
+			img, err := decodeImage(file)
+			if err != nil {
+				Goback(w, r, err)
+				return
+			}
+
+			id, _, err = storeImage(img, kind)
+			if err != nil {
+				Goback(w, r, err)
+				return
+			}
+		}
+
+		helper.setImage(user.UserId, kind, id)
+		if helper.err != nil {
+			Goback(w, r, helper.err)
+			return
+		}
+
+		http.Redirect(w, r, "/settings/profile", http.StatusFound)
+	}
+}
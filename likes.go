@@ -0,0 +1,280 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/context"
+)
+
+// likes:<postId> has the users who liked the post and liked:<userId> the
+// posts the user liked, both scored by the time of the like. They change
+// together in one transaction and the count is the size of the set, so
+// liking twice or two clicks at once can't put it off.
+
+type LikeResource struct {
+	PostId string `json:"postId"`
+	Liked  bool   `json:"liked"`
+	Likes  int    `json:"likes"`
+}
+
+type ExportLike struct {
+	PostId string `json:"postId"`
+	Time   string `json:"time"`
+}
+
+func (p *Post) LikeCount() int {
+	if p.Stats != nil {
+		return p.Stats.Likes
+	}
+
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	count, _ := redis.Int(redisConn.Do("ZCARD", "likes:"+p.Id))
+	return count
+}
+
+func (p *Post) HasLiked(userId string) bool {
+	if p.viewedBy(userId) {
+		return p.Stats.Liked
+	}
+
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	_, err := redis.Int64(redisConn.Do("ZSCORE", "likes:"+p.Id, userId))
+	return err == nil
+}
+
+// like reports whether the post wasn't liked by the user before.
+func (helper *DBHelper) like(user *User, post *Post) bool {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	now := time.Now().Unix()
+	redisConn.Send("MULTI")
+	redisConn.Send("ZADD", "likes:"+post.Id, "NX", now, user.UserId)
+	redisConn.Send("ZADD", "liked:"+user.UserId, "NX", now, post.Id)
+	var replies []int
+	replies, helper.err = redis.Ints(redisConn.Do("EXEC"))
+	if helper.err != nil || replies[0] == 0 {
+		return false
+	}
+
+	if post.UserId != user.UserId {
+		helper.notify(post.UserId, &Notification{
+			Kind: "like",
+			Text: user.UserName + " liked your post",
+			Link: "/post/" + post.Id,
+		})
+	}
+	return true
+}
+
+func (helper *DBHelper) unlike(user *User, post *Post) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	redisConn.Send("MULTI")
+	redisConn.Send("ZREM", "likes:"+post.Id, user.UserId)
+	redisConn.Send("ZREM", "liked:"+user.UserId, post.Id)
+	_, helper.err = redisConn.Do("EXEC")
+}
+
+// forgetLikes removes the likes of the post from the likers.
+func (helper *DBHelper) forgetLikes(postId string) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var userIds []string
+	userIds, helper.err = redis.Strings(redisConn.Do("ZRANGE", "likes:"+postId, 0, -1))
+	if helper.err != nil {
+		return
+	}
+
+	redisConn.Send("MULTI")
+	for _, userId := range userIds {
+		redisConn.Send("ZREM", "liked:"+userId, postId)
+	}
+	redisConn.Send("DEL", "likes:"+postId)
+	_, helper.err = redisConn.Do("EXEC")
+}
+
+// getLikedPosts returns the posts the user liked, the latest like first.
+func (helper *DBHelper) getLikedPosts(userId string, viewerId string, start int64, count int64) ([]*Post, int64) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var (
+		values []string
+		length int64
+	)
+	values, helper.err = redis.Strings(redisConn.Do("ZREVRANGE", "liked:"+userId, start, start+count-1))
+	posts := []*Post{}
+
+	for _, postId := range values {
+		post := helper.getPost(postId)
+		if post.UserId == "" {
+			continue
+		}
+		post.Time = strElapsed(post.Time)
+		posts = append(posts, post)
+	}
+
+	length, helper.err = redis.Int64(redisConn.Do("ZCARD", "liked:"+userId))
+	helper.loadPostStats(posts, viewerId)
+	if helper.err != nil {
+		return posts, 0
+	}
+	return posts, length - start - int64(len(values))
+}
+
+// purgeLikes takes back the likes of the user, a batch per call.
+func (helper *DBHelper) purgeLikes(userId string, cursor string) (string, bool) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	if cursor == "" {
+		cursor = "0"
+	}
+
+	var values []interface{}
+	values, helper.err = redis.Values(redisConn.Do("ZSCAN", "liked:"+userId, cursor, "COUNT", deletionBatch))
+	if helper.err != nil {
+		return cursor, false
+	}
+
+	// The members come with their scores.
+	var members []string
+	cursor, _ = redis.String(values[0], nil)
+	members, helper.err = redis.Strings(values[1], nil)
+	if helper.err != nil {
+		return cursor, false
+	}
+
+	redisConn.Send("MULTI")
+	for i := 0; i < len(members); i += 2 {
+		redisConn.Send("ZREM", "likes:"+members[i], userId)
+	}
+	if cursor == "0" {
+		redisConn.Send("DEL", "liked:"+userId)
+	}
+	_, helper.err = redisConn.Do("EXEC")
+	return cursor, helper.err == nil && cursor == "0"
+}
+
+func (helper *DBHelper) exportLikes(user *User) interface{} {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var values []string
+	values, helper.err = redis.Strings(redisConn.Do("ZRANGE", "liked:"+user.UserId, 0, -1, "WITHSCORES"))
+
+	likes := []*ExportLike{}
+	for i := 0; i+1 < len(values); i += 2 {
+		t, _ := strconv.ParseInt(values[i+1], 10, 64)
+		likes = append(likes, &ExportLike{values[i], exportTime(t)})
+	}
+	return likes
+}
+
+// likedPostParam loads the post of the route, the reposted post for a
+// repost.
+func (helper *DBHelper) likedPostParam(r *http.Request) *Post {
+	post := helper.postParam(r)
+	if helper.err == nil && post.RepostOf != "" {
+		post = helper.resolvePost(post.Id)
+		if helper.err == nil && post.UserId == "" {
+			helper.err = ErrPostNotFound
+		}
+	}
+	return post
+}
+
+// Like Handlers
+
+func likeHandler(undo bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		helper := DBHelper{}
+		user := context.Get(r, "user").(*User)
+
+		if !checkCSRF(r, user.UserId, "post") {
+			Goback(w, r, errors.New("Your session has expired, please reload the page."))
+			return
+		}
+
+		post := helper.likedPostParam(r)
+		if helper.err != nil {
+			Goback(w, r, helper.err)
+			return
+		}
+
+		if undo {
+			helper.unlike(user, post)
+		} else {
+			helper.like(user, post)
+		}
+		if helper.err != nil {
+			Goback(w, r, helper.err)
+			return
+		}
+
+		redirectBack(w, r)
+	}
+}
+
+func apiLikeHandler(undo bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		helper := DBHelper{}
+		user := context.Get(r, "user").(*User)
+
+		post := helper.likedPostParam(r)
+		if helper.err == ErrPostNotFound {
+			WriteError(w, ErrNotFound)
+			return
+		}
+		if helper.err != nil {
+			WriteError(w, ErrInternalServer)
+			return
+		}
+
+		if undo {
+			helper.unlike(user, post)
+		} else {
+			helper.like(user, post)
+		}
+		if helper.err != nil {
+			WriteError(w, ErrInternalServer)
+			return
+		}
+
+		tmplRender.JSON(w, http.StatusOK, Response{"ok", &LikeResource{post.Id, !undo, post.LikeCount()}})
+	}
+}
+
+func apiLikesHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	start, err := strconv.ParseInt(r.FormValue("start"), 10, 64)
+	if err != nil || start < 0 {
+		start = 0
+	}
+
+	posts, rest := helper.getLikedPosts(user.UserId, user.UserId, start, 20)
+	if helper.err != nil {
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	resource := PostsResource{Posts: posts}
+	if rest > 0 {
+		resource.Next = start + 20
+	}
+
+	tmplRender.JSON(w, http.StatusOK, Response{"ok", resource})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	smtpServer   = flag.String("smtpServer", "", "host:port of the SMTP server, mail is written to mailDir when empty")
+	smtpUser     = flag.String("smtpUser", "", "")
+	smtpPassword = flag.String("smtpPassword", "", "")
+	mailFrom     = flag.String("mailFrom", "SimpleGo <noreply@localhost>", "")
+	mailDir      = flag.String("mailDir", "mail", "directory mail is written to when no SMTP server is configured")
+
+	mailer Mailer
+)
+
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Bytes formats the mail as a RFC 5322 message.
+func (m *Mail) Bytes(from string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", m.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@simplego>\r\n", randomToken(16))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	b.WriteString(m.Body)
+	return b.Bytes()
+}
+
+type Mailer interface {
+	Send(mail *Mail) error
+}
+
+type SMTPMailer struct {
+	Addr     string
+	From     string
+	User     string
+	Password string
+}
+
+func (m *SMTPMailer) Send(mail *Mail) error {
+	var auth smtp.Auth
+	if m.User != "" {
+		host, _, _ := net.SplitHostPort(m.Addr)
+		auth = smtp.PlainAuth("", m.User, m.Password, host)
+	}
+	return smtp.SendMail(m.Addr, auth, envelopeAddress(m.From), []string{mail.To}, mail.Bytes(m.From))
+}
+
+// DirMailer writes every mail to its own file, which is handy in development
+// and for tests.
+type DirMailer struct {
+	Dir  string
+	From string
+}
+
+func (m *DirMailer) Send(mail *Mail) error {
+	if err := os.MkdirAll(m.Dir, 0700); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), randomToken(4))
+	return ioutil.WriteFile(filepath.Join(m.Dir, name), mail.Bytes(m.From), 0600)
+}
+
+func NewMailer() Mailer {
+	if *smtpServer != "" {
+		return &SMTPMailer{*smtpServer, *mailFrom, *smtpUser, *smtpPassword}
+	}
+	return &DirMailer{*mailDir, *mailFrom}
+}
+
+func envelopeAddress(from string) string {
+	if addr, err := parseEmail(from); err == nil {
+		return addr
+	}
+	return from
+}
@@ -6,10 +6,12 @@ import (
 	"flag"
 	"log"
 	"net/http"
+	"net/url"
 	"reflect"
 	"time"
 
 	"strconv"
+	"strings"
 
 	"github.com/garyburd/redigo/redis"
 	"github.com/gorilla/context"
@@ -50,6 +52,8 @@ var (
 	ErrUnsupportedMediaType = &Error{"unsupported_media_type", 415, "Unsupported Media Type", "Content-Type header must be set to: 'application/json'."}
 	ErrInternalServer       = &Error{"internal_server_error", 500, "Internal Server Error", "Something went wrong."}
 	ErrNotFound             = &Error{"not_found", 404, "Not Found", "Not Found."}
+	ErrUnauthorized         = &Error{"unauthorized", 401, "Unauthorized", "A valid access token is required."}
+	ErrForbidden            = &Error{"forbidden", 403, "Forbidden", "The access token doesn't grant access to this resource."}
 )
 
 //Display error relate html file
@@ -89,11 +93,12 @@ func recoverHandler(next http.Handler) http.Handler {
 func authHandler(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		helper := DBHelper{}
-		userId := getUser(r)
-		if userId != "" {
+		userId, version := getUser(r)
+		if userId != "" && refreshSession(r, w) {
 			user := helper.loadUserInfo(userId)
-			if helper.err == nil {
+			if helper.err == nil && user.SessionVersion == version {
 				context.Set(r, "user", user)
+				helper.touchSession(userId, getSessionId(r), r)
 			}
 		}
 		next.ServeHTTP(w, r)
@@ -102,6 +107,18 @@ func authHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(fn)
 }
 
+func loginRequiredHandler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if context.Get(r, "user") == nil {
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
 func contentTypeHandler(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		if r.Header.Get("Content-Type") != "application/json" {
@@ -150,83 +167,135 @@ type Response struct {
 }
 
 type Post struct {
-	UserId   string `redis:"userId"`
-	Time     string `redis:"time"`
-	Body     string `redis:"body"`
-	UserName string
+	UserId   string `redis:"userId" json:"userId"`
+	Time     string `redis:"time" json:"time"`
+	Body     string `redis:"body" json:"body"`
+	UserName string `json:"userName"`
+	Avatar   string `redis:"-" json:"-"`
+
+	Id     string `redis:"-" json:"id"`
+	Posted int64  `redis:"-" json:"-"`
+	Edited int64  `redis:"edited" json:"edited,omitempty"`
+
+	InReplyTo  string `redis:"inReplyTo" json:"inReplyTo,omitempty"`
+	RepostOf   string `redis:"repostOf" json:"repostOf,omitempty"`
+	RepostedBy string `redis:"-" json:"repostedBy,omitempty"`
+	QuoteOf    string `redis:"quoteOf" json:"quoteOf,omitempty"`
+	Quoted     *Post  `redis:"-" json:"quoted,omitempty"`
+
+	AttachmentData string        `redis:"attachments" json:"-"`
+	Attachments    []*Attachment `redis:"-" json:"attachments,omitempty"`
+
+	MentionData string   `redis:"mentions" json:"-"`
+	Mentions    []string `redis:"-" json:"mentions,omitempty"`
+	TagData     string   `redis:"tags" json:"-"`
+	Tags        []string `redis:"-" json:"tags,omitempty"`
+
+	Stats        *PostStats `redis:"-" json:"stats,omitempty"`
+	mentionNames map[string]string
+}
+
+func (p *Post) AvatarURL() string {
+	return avatarURL(p.Avatar, 48)
 }
 
 // Main Handlers
 
 func registerHandler(w http.ResponseWriter, r *http.Request) {
-	redisConn := redisPool.Get()
-	defer redisConn.Close()
+	helper := DBHelper{}
 
 	userName := r.PostFormValue("username")
 	password := r.PostFormValue("password")
 
 	passwordVerify := r.PostFormValue("password2")
 
-	if userName == "" || password == "" || passwordVerify == "" {
+	if userName == "" || password == "" || passwordVerify == "" || r.PostFormValue("email") == "" {
 		Goback(w, r, errors.New("Every field of the registration form is needed!"))
 		return
 	}
 
-	if password != passwordVerify {
-		Goback(w, r, errors.New("The two password fileds don't match!"))
-		return
-	}
-	password, err := encryptedPassword(r.PostFormValue("password"))
+	userName, err := parseUserName(userName)
 	if err != nil {
 		Goback(w, r, err)
 		return
 	}
 
-	userExistId, err := redisConn.Do("HGET", "users", userName)
-
+	email, err := parseEmail(r.PostFormValue("email"))
 	if err != nil {
 		Goback(w, r, err)
-
 		return
 	}
 
-	if userExistId != nil {
-		Goback(w, r, errors.New("Sorry the selected username is already in use."))
+	if password != passwordVerify {
+		Goback(w, r, errors.New("The two password fileds don't match!"))
 		return
 	}
 
-	userId, _ := redis.Int(redisConn.Do("INCR", "next_user_id"))
-
-	tableName := "user:" + strconv.Itoa(userId)
-
-	userInfo := User{UserId: strconv.Itoa(userId), UserName: userName, Password: password}
+	if err := checkPassword(password, userName); err != nil {
+		Goback(w, r, err)
+		return
+	}
 
-	_, err = redisConn.Do("HMSET", redis.Args{}.Add(tableName).AddFlat(&userInfo)...)
+	password, err = encryptedPassword(r.PostFormValue("password"))
 	if err != nil {
 		Goback(w, r, err)
+		return
+	}
 
+	// The address is claimed first, a registration losing the race for it
+	// must not leave an account behind.
+	helper.reserveEmail(email)
+	if helper.err != nil {
+		Goback(w, r, helper.err)
 		return
 	}
 
-	_, err = redisConn.Do("HSET", "users", userName, userId)
+	inviterId := helper.admitRegistration(r)
 
-	if err != nil {
+	if helper.err != nil {
+		err = helper.err
+		helper.releaseEmail(email)
 		Goback(w, r, err)
 		return
 	}
 
-	_, err = redisConn.Do("ZADD", "users_by_time", time.Now().Unix(), userName)
+	userId := helper.createUser(userName, password)
 
-	if err != nil {
+	if helper.err != nil {
+		err = helper.err
+		helper.releaseEmail(email)
+		if inviterId != "" {
+			helper.restoreInvite(inviterId, strings.TrimSpace(r.PostFormValue("invite")))
+		}
 		Goback(w, r, err)
+		return
+	}
 
+	if inviterId != "" {
+		helper.recordInvite(inviterId, userId)
+	}
+
+	user := &User{UserId: userId, UserName: userName}
+	helper.registerEmail(user, email)
+
+	if helper.err != nil {
+		Goback(w, r, helper.err)
 		return
 	}
 
-	setSession(strconv.Itoa(userId), r, w)
+	helper.sendVerification(user)
+
+	if helper.err != nil {
+		log.Printf("err in send verification mail %v", helper.err)
+	}
+
+	setSession(userId, false, r, w)
+	helper.rememberDevice(userId, deviceId(r, w))
 
 	templateParams := map[string]interface{}{}
 	templateParams["username"] = userName
+	templateParams["email"] = email
+	templateParams["verify"] = requireVerifiedEmail()
 	tmplRender.HTML(w, http.StatusOK, "register", templateParams)
 }
 
@@ -248,25 +317,26 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userExistId, err := redisConn.Do("HGET", "users", userName)
+	helper := DBHelper{}
+	userId := helper.getUserId(userName)
 
-	if err != nil {
-		Goback(w, r, err)
+	if helper.err == redis.ErrNil {
+		Goback(w, r, errors.New("Wrong username or password"))
 
 		return
 	}
 
-	if userExistId == nil {
-		Goback(w, r, errors.New("Wrong username or password"))
+	if helper.err != nil {
+		Goback(w, r, helper.err)
 
 		return
 	}
 
-	userId, _ := redis.Int(redisConn.Do("HGET", "users", userName))
-	tableName := "user:" + strconv.Itoa(userId)
+	tableName := "user:" + userId
 	realPassword, _ := redis.String(redisConn.Do("hget", tableName, "password"))
 
 	if realPassword != password {
+		loginFailed(userId, "password", r)
 
 		Goback(w, r, errors.New("Wrong username or password"))
 
@@ -278,8 +348,42 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	setSession(strconv.Itoa(userId), r, w)
-	http.Redirect(w, r, "/", http.StatusFound)
+	user := helper.loadUserInfo(userId)
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+
+	if user.NeedsSecondFactor() {
+		setPendingLogin(user.UserId, r.PostFormValue("next"), r.PostFormValue("remember") != "", r, w)
+
+		templateParams := map[string]interface{}{}
+		templateParams["totp"] = user.HasTwoFactor()
+		templateParams["passkeys"] = user.HasPasskeys()
+		tmplRender.HTML(w, http.StatusOK, "twofactor", templateParams)
+		return
+	}
+
+	loginSucceeded(user.UserId, "password", r.PostFormValue("remember") != "", r, w)
+	http.Redirect(w, r, localPath(r.PostFormValue("next")), http.StatusFound)
+}
+
+func welcomeParams(next string) map[string]interface{} {
+	templateParams := map[string]interface{}{}
+	templateParams["next"] = next
+	templateParams["registration"] = *registrationMode
+	if oidcEnabled() {
+		templateParams["oidc"] = *oidcName
+	}
+	return templateParams
+}
+
+// localPath only lets redirects to paths on this site through.
+func localPath(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
 }
 
 func indexHandler(w http.ResponseWriter, r *http.Request) {
@@ -288,7 +392,7 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 	user := context.Get(r, "user")
 
 	if user == nil {
-		tmplRender.HTML(w, http.StatusOK, "welcome", nil)
+		tmplRender.HTML(w, http.StatusOK, "welcome", welcomeParams(""))
 
 	} else {
 		http.Redirect(w, r, "/home", http.StatusFound)
@@ -301,6 +405,14 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
 	user := context.Get(r, "user").(*User)
 	templateParams := map[string]interface{}{}
 	templateParams["user"] = user
+	templateParams["attachmentSlots"] = make([]struct{}, maxAttachments)
+
+	quote := helper.quoteParam(r)
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+	templateParams["quote"] = quote
 
 	var start int64
 	var err error
@@ -314,7 +426,17 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	posts, rest := helper.getUserPosts(user.UserId, start, 10)
+	var (
+		posts []*Post
+		rest  int64
+	)
+	if r.FormValue("tab") == "mentions" {
+		templateParams["tab"] = "mentions"
+		posts, rest = helper.getMentionPosts(user.UserId, user.UserId, start, 10)
+	} else {
+		templateParams["tab"] = ""
+		posts, rest = helper.getUserPosts(user.UserId, user.UserId, start, 10)
+	}
 
 	if helper.err == nil {
 
@@ -340,20 +462,43 @@ func postHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	r.Body = http.MaxBytesReader(w, r.Body, maxAttachments*(*maxImageBytes)+1<<20)
 	status := r.PostFormValue("status")
 
-	if status == "" {
+	attachments, err := formAttachments(r)
+	if err != nil {
+		Goback(w, r, err)
+		return
+	}
+
+	if status == "" && len(attachments) == 0 {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
 
-	helper.post(user.UserId, status)
+	if !user.CanPost() {
+		Goback(w, r, ErrUnverifiedEmail)
+		return
+	}
+
+	post := &Post{
+		UserId:      user.UserId,
+		Body:        status,
+		Attachments: attachments,
+		InReplyTo:   r.PostFormValue("in_reply_to"),
+		QuoteOf:     r.PostFormValue("quote_of"),
+	}
+	helper.post(post)
 
 	if helper.err != nil {
 		Goback(w, r, helper.err)
 		return
 	}
 
+	if post.InReplyTo != "" {
+		http.Redirect(w, r, "/post/"+post.InReplyTo, http.StatusFound)
+		return
+	}
 	http.Redirect(w, r, "/", http.StatusFound)
 
 }
@@ -369,6 +514,14 @@ func profileHandler(w http.ResponseWriter, r *http.Request) {
 
 	userOther := helper.getUserFromName(userName)
 
+	if helper.err == redis.ErrNil {
+		// The user may have been renamed recently.
+		if renamed := helper.getRenamedUser(userName); renamed != nil {
+			http.Redirect(w, r, "/Profile?u="+url.QueryEscape(renamed.UserName), http.StatusFound)
+			return
+		}
+	}
+
 	if helper.err != nil {
 		Goback(w, r, helper.err)
 		return
@@ -393,7 +546,17 @@ func profileHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	posts, rest := helper.getUserPosts(userOther.UserId, start, 10)
+	var (
+		posts []*Post
+		rest  int64
+	)
+	if r.FormValue("tab") == "likes" {
+		templateParams["tab"] = "likes"
+		posts, rest = helper.getLikedPosts(userOther.UserId, userMe.UserId, start, 10)
+	} else {
+		templateParams["tab"] = ""
+		posts, rest = helper.getUserPosts(userOther.UserId, userMe.UserId, start, 10)
+	}
 
 	if helper.err == nil {
 
@@ -421,12 +584,13 @@ func timelineHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	posts, _ := helper.getLatestTimeLine(0, 50)
+	posts, _ := helper.getLatestTimeLine(viewerId(r), 0, 50)
 
 	if helper.err != nil {
 		Goback(w, r, helper.err)
 		return
 	}
+	templateParams["user"] = context.Get(r, "user")
 	templateParams["users"] = users
 	templateParams["posts"] = posts
 
@@ -537,6 +701,7 @@ var (
 	redisPool   *redis.Pool
 	redisStore  *redistore.RediStore
 	redisServer = flag.String("redisServer", "192.168.59.103:49153", "")
+	baseURL     = flag.String("baseURL", "http://localhost:8000", "public url of the site, used in links leaving the site")
 )
 
 func main() {
@@ -548,9 +713,24 @@ func main() {
 	redisStore = NewRedisStore(redisPool)
 	defer redisStore.Close()
 
-	satic := Static{http.Dir("public")}
+	mailer = NewMailer()
+	blobs = newLocalBlobStore(*mediaDir)
+
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	initPasswordPolicy()
+
+	satic := Static{Dir: http.Dir("public")}
+	media := Static{Dir: blobs, MaxAge: 365 * 24 * time.Hour}
 
 	commonHandler := alice.New(context.ClearHandler, loggingHandler, recoverHandler, authHandler)
+	userHandler := commonHandler.Append(loginRequiredHandler)
+	apiHandler := alice.New(context.ClearHandler, loggingHandler, recoverHandler)
 
 	router := NewRouter()
 	router.NotFound = satic.saticHandler
@@ -560,11 +740,94 @@ func main() {
 	router.Post("/post", commonHandler.ThenFunc(postHandler))
 	router.Post("/register", commonHandler.ThenFunc(registerHandler))
 	router.Post("/login", commonHandler.ThenFunc(loginHandler))
+	router.Post("/login/2fa", commonHandler.ThenFunc(loginTwoFactorHandler))
+	router.Get("/login/oidc", commonHandler.ThenFunc(oidcLoginHandler))
+	router.Get("/login/oidc/callback", commonHandler.ThenFunc(oidcCallbackHandler))
+	router.Post("/login/oidc/register", commonHandler.ThenFunc(oidcRegisterHandler))
 	router.Get("/follow", commonHandler.ThenFunc(followHandler))
 	router.Get("/unfollow", commonHandler.ThenFunc(unfollowHandler))
 	router.Get("/Profile", commonHandler.ThenFunc(profileHandler))
+	router.Get("/post/:id", commonHandler.ThenFunc(threadHandler))
+	router.Get("/tag/:name", commonHandler.ThenFunc(tagHandler))
+	router.Get("/post/:id/edit", userHandler.ThenFunc(editPostHandler))
+	router.Post("/post/:id/edit", userHandler.ThenFunc(savePostHandler))
+	router.Post("/post/:id/delete", userHandler.ThenFunc(deletePostHandler))
+	router.Post("/post/:id/repost", userHandler.ThenFunc(repostHandler(false)))
+	router.Post("/post/:id/unrepost", userHandler.ThenFunc(repostHandler(true)))
+	router.Post("/post/:id/like", userHandler.ThenFunc(likeHandler(false)))
+	router.Post("/post/:id/unlike", userHandler.ThenFunc(likeHandler(true)))
+	router.Post("/post/:id/react", userHandler.ThenFunc(reactHandler))
+	router.Get("/post/:id/history", commonHandler.ThenFunc(postHistoryHandler))
 	router.Get("/timeline", commonHandler.ThenFunc(timelineHandler))
+	router.Get("/media/*filepath", apiHandler.Then(http.StripPrefix("/media", http.HandlerFunc(media.saticHandler))))
 	router.Get("/logout", commonHandler.ThenFunc(logoutHandler))
 
+	router.Get("/forgot", commonHandler.ThenFunc(forgotHandler))
+	router.Post("/forgot", commonHandler.ThenFunc(sendResetHandler))
+	router.Get("/reset", commonHandler.ThenFunc(resetHandler))
+	router.Post("/reset", commonHandler.ThenFunc(resetPasswordHandler))
+	router.Get("/verify", commonHandler.ThenFunc(verifyHandler))
+	router.Get("/settings", userHandler.ThenFunc(settingsHandler))
+	router.Post("/settings/verify", userHandler.ThenFunc(resendVerificationHandler))
+	router.Get("/invites", userHandler.ThenFunc(invitesHandler))
+	router.Post("/invites", userHandler.ThenFunc(createInviteHandler))
+	router.Get("/admin/invites", userHandler.ThenFunc(adminInvitesHandler))
+	router.Post("/settings/email", userHandler.ThenFunc(emailHandler))
+	router.Post("/settings/username", userHandler.ThenFunc(renameHandler))
+	router.Get("/settings/profile", userHandler.ThenFunc(editProfileHandler))
+	router.Post("/settings/profile", userHandler.ThenFunc(saveProfileHandler))
+	router.Post("/settings/avatar", userHandler.ThenFunc(uploadImageHandler(avatarImage)))
+	router.Post("/settings/header", userHandler.ThenFunc(uploadImageHandler(headerImage)))
+	router.Get("/settings/export", userHandler.ThenFunc(exportHandler))
+	router.Post("/settings/export", userHandler.ThenFunc(requestExportHandler))
+	router.Get("/settings/export/download", userHandler.ThenFunc(downloadExportHandler))
+	router.Post("/settings/delete", userHandler.ThenFunc(deleteAccountHandler))
+	router.Post("/settings/delete/cancel", userHandler.ThenFunc(cancelDeletionHandler))
+	router.Post("/settings/password", userHandler.ThenFunc(changePasswordHandler))
+	router.Get("/settings/sessions", userHandler.ThenFunc(sessionsHandler))
+	router.Get("/settings/security", userHandler.ThenFunc(securityHandler))
+	router.Get("/notifications", userHandler.ThenFunc(notificationsHandler))
+	router.Post("/settings/sessions/revoke", userHandler.ThenFunc(revokeSessionHandler))
+	router.Post("/settings/sessions/revoke-others", userHandler.ThenFunc(revokeOtherSessionsHandler))
+	router.Get("/settings/passkeys", userHandler.ThenFunc(passkeysHandler))
+	router.Post("/settings/passkeys/delete", userHandler.ThenFunc(deletePasskeyHandler))
+	router.Get("/settings/2fa", userHandler.ThenFunc(twoFactorHandler))
+	router.Get("/settings/2fa/qr.png", userHandler.ThenFunc(twoFactorQRHandler))
+	router.Post("/settings/2fa/enable", userHandler.ThenFunc(enableTwoFactorHandler))
+	router.Post("/settings/2fa/disable", userHandler.ThenFunc(disableTwoFactorHandler))
+	router.Post("/settings/2fa/recovery", userHandler.ThenFunc(recoveryCodesHandler))
+
+	router.Get("/oauth/clients", userHandler.ThenFunc(oauthClientsHandler))
+	router.Post("/oauth/clients", userHandler.ThenFunc(oauthRegisterClientHandler))
+	router.Get("/oauth/authorize", commonHandler.ThenFunc(oauthAuthorizeHandler))
+	router.Post("/oauth/authorize", userHandler.ThenFunc(oauthConsentHandler))
+	router.Post("/oauth/token", apiHandler.ThenFunc(oauthTokenHandler))
+
+	passkeyHandler := commonHandler.Append(contentTypeHandler, bodyHandler(credentialResponse{}))
+	router.Post("/webauthn/register/begin", userHandler.ThenFunc(beginPasskeyRegistrationHandler))
+	router.Post("/webauthn/register/finish", userHandler.Append(contentTypeHandler, bodyHandler(credentialResponse{})).ThenFunc(finishPasskeyRegistrationHandler))
+	router.Post("/webauthn/login/begin", commonHandler.ThenFunc(beginPasskeyLoginHandler))
+	router.Post("/webauthn/login/finish", passkeyHandler.ThenFunc(finishPasskeyLoginHandler))
+	router.Post("/webauthn/2fa/begin", commonHandler.ThenFunc(beginPasskeySecondFactorHandler))
+	router.Post("/webauthn/2fa/finish", passkeyHandler.ThenFunc(finishPasskeySecondFactorHandler))
+
+	router.Get("/api/me", apiHandler.Append(scopeHandler("read")).ThenFunc(apiMeHandler))
+	router.Get("/api/posts", apiHandler.Append(scopeHandler("read")).ThenFunc(apiPostsHandler))
+	router.Post("/api/media", apiHandler.Append(scopeHandler("write")).ThenFunc(apiUploadMediaHandler))
+	router.Get("/api/tags/:name", apiHandler.Append(scopeHandler("read")).ThenFunc(apiTagHandler))
+	router.Get("/api/mentions", apiHandler.Append(scopeHandler("read")).ThenFunc(apiMentionsHandler))
+	router.Get("/api/likes", apiHandler.Append(scopeHandler("read")).ThenFunc(apiLikesHandler))
+	router.Post("/api/posts/:id/like", apiHandler.Append(scopeHandler("write")).ThenFunc(apiLikeHandler(false)))
+	router.Post("/api/posts/:id/unlike", apiHandler.Append(scopeHandler("write")).ThenFunc(apiLikeHandler(true)))
+	router.Get("/api/posts/:id/reactions", apiHandler.Append(scopeHandler("read")).ThenFunc(apiReactionsHandler))
+	router.Post("/api/posts/:id/react", apiHandler.Append(scopeHandler("write"), contentTypeHandler, bodyHandler(ReactionRequest{})).ThenFunc(apiReactHandler(false)))
+	router.Post("/api/posts/:id/unreact", apiHandler.Append(scopeHandler("write"), contentTypeHandler, bodyHandler(ReactionRequest{})).ThenFunc(apiReactHandler(true)))
+	router.Post("/api/posts", apiHandler.Append(scopeHandler("write"), contentTypeHandler, bodyHandler(PostRequest{})).ThenFunc(apiCreatePostHandler))
+
+	go runDeletions()
+	go runExports()
+	go runMediaGC()
+	go runPostSweeps()
+
 	http.ListenAndServe(":8000", router)
 }
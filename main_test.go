@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/context"
+)
+
+// The tests needing Redis use the server in SIMPLEGO_TEST_REDIS, for example
+// localhost:6379, and flush its database first. They are skipped without it.
+func setupRedis(t *testing.T) {
+	t.Helper()
+
+	server := os.Getenv("SIMPLEGO_TEST_REDIS")
+	if server == "" {
+		t.Skip("SIMPLEGO_TEST_REDIS is not set")
+	}
+
+	redisPool = NewPool(server)
+	redisStore = NewRedisStore(redisPool)
+	mailer = &DirMailer{Dir: t.TempDir(), From: *mailFrom}
+	t.Cleanup(func() { redisStore.Close() })
+
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+	if _, err := redisConn.Do("FLUSHDB"); err != nil {
+		t.Fatalf("flush %s: %v", server, err)
+	}
+}
+
+func createTestUser(t *testing.T, userName string, password string) string {
+	t.Helper()
+
+	helper := DBHelper{}
+	encrypted, err := encryptedPassword(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userId := helper.createUser(userName, encrypted)
+	if helper.err != nil {
+		t.Fatalf("create user %s: %v", userName, helper.err)
+	}
+	return userId
+}
+
+// testBrowser sends requests through authHandler like the routes do and
+// keeps the cookies from one request to the next.
+type testBrowser struct {
+	cookies map[string]*http.Cookie
+}
+
+func newTestBrowser() *testBrowser {
+	return &testBrowser{cookies: map[string]*http.Cookie{}}
+}
+
+func (b *testBrowser) do(h http.HandlerFunc, r *http.Request) *httptest.ResponseRecorder {
+	for _, cookie := range b.cookies {
+		r.AddCookie(cookie)
+	}
+
+	w := httptest.NewRecorder()
+	context.ClearHandler(authHandler(h)).ServeHTTP(w, r)
+
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.MaxAge < 0 {
+			delete(b.cookies, cookie.Name)
+		} else {
+			b.cookies[cookie.Name] = cookie
+		}
+	}
+	return w
+}
+
+func (b *testBrowser) get(h http.HandlerFunc, target string) *httptest.ResponseRecorder {
+	return b.do(h, httptest.NewRequest("GET", target, nil))
+}
+
+func (b *testBrowser) post(h http.HandlerFunc, target string, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return b.do(h, r)
+}
+
+// postJSON hands the body to the handler the way bodyHandler does.
+func (b *testBrowser) postJSON(h http.HandlerFunc, target string, body interface{}) *httptest.ResponseRecorder {
+	data, err := json.Marshal(body)
+	if err != nil {
+		panic(err)
+	}
+	r := httptest.NewRequest("POST", target, bytes.NewReader(data))
+	r.Header.Set("Content-Type", "application/json")
+	return b.do(func(w http.ResponseWriter, r *http.Request) {
+		context.Set(r, "body", body)
+		h(w, r)
+	}, r)
+}
+
+// userId returns who the browser is signed in as.
+func (b *testBrowser) userId() string {
+	var userId string
+	b.get(func(w http.ResponseWriter, r *http.Request) {
+		if user, ok := context.Get(r, "user").(*User); ok {
+			userId = user.UserId
+		}
+	}, "/")
+	return userId
+}
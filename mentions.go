@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"regexp"
+	"sort"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// The users mentioned as @username are looked up when the post is written
+// and kept as JSON in the mentions field of post:<id>, mapping the username
+// key to the user id. Only those names are linked, a user registering the
+// name later doesn't take over the mention. mentions:<userId> lists the
+// posts mentioning the user, newest first, whether they follow the author or
+// not.
+
+const maxMentions = 10
+
+// mentionPattern matches @username at the start of the body or after
+// something which can't be part of a name or an email address. Combining
+// marks are part of the name, userNameKey composes them.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{M}\p{N}_@])@([\p{L}\p{N}_][\p{L}\p{M}\p{N}_]*)`)
+
+// mentionNames returns the names mentioned in the body, every name once.
+func mentionNames(body string) []string {
+	names := []string{}
+	seen := map[string]bool{}
+	for _, match := range mentionPattern.FindAllStringSubmatch(body, -1) {
+		key := userNameKey(match[1])
+		if seen[key] || len(names) == maxMentions {
+			continue
+		}
+		seen[key] = true
+		names = append(names, match[1])
+	}
+	return names
+}
+
+// findMentions looks up the users mentioned in the body.
+func (helper *DBHelper) findMentions(body string) map[string]string {
+	mentions := map[string]string{}
+	for _, name := range mentionNames(body) {
+		userId := helper.getUserId(name)
+		if helper.err == redis.ErrNil {
+			helper.err = nil
+			continue
+		}
+		if helper.err != nil {
+			return nil
+		}
+		mentions[userNameKey(name)] = userId
+	}
+	return mentions
+}
+
+func encodeMentions(mentions map[string]string) string {
+	if len(mentions) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(mentions)
+	return string(data)
+}
+
+func parseMentions(data string) map[string]string {
+	mentions := map[string]string{}
+	if data != "" {
+		json.Unmarshal([]byte(data), &mentions)
+	}
+	return mentions
+}
+
+// mentionIds returns the ids of the users the post mentions, sorted.
+func mentionIds(mentions map[string]string) []string {
+	userIds := []string{}
+	for _, userId := range mentions {
+		userIds = append(userIds, userId)
+	}
+	sort.Strings(userIds)
+	return userIds
+}
+
+// mentionLinks links the mentions to the profiles, under the current name of
+// the user.
+func (p *Post) mentionLinks() []*bodyLink {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	mentions := parseMentions(p.MentionData)
+	links := []*bodyLink{}
+	for _, match := range mentionPattern.FindAllStringSubmatchIndex(p.Body, -1) {
+		userId, ok := mentions[userNameKey(p.Body[match[2]:match[3]])]
+		if !ok {
+			continue
+		}
+		userName, ok := p.mentionNames[userId]
+		if p.mentionNames == nil {
+			var err error
+			userName, err = redis.String(redisConn.Do("HGET", "user:"+userId, "userName"))
+			ok = err == nil
+		}
+		if !ok {
+			continue
+		}
+		links = append(links, &bodyLink{match[2] - 1, match[3], "mention", "/Profile?u=" + url.QueryEscape(userName)})
+	}
+	return links
+}
+
+// deliverMentions puts the post on the mentions timelines of the users and
+// lets them know. The author of the post replied to or quoted already got a
+// notification for it.
+func (helper *DBHelper) deliverMentions(post *Post, userIds []string, notified ...string) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	skip := map[string]bool{post.UserId: true}
+	for _, userId := range notified {
+		skip[userId] = true
+	}
+
+	for _, userId := range userIds {
+		if userId == post.UserId {
+			continue
+		}
+		_, helper.err = redisConn.Do("LPUSH", "mentions:"+userId, post.Id)
+		if helper.err != nil {
+			return
+		}
+		if !skip[userId] {
+			helper.notify(userId, &Notification{
+				Kind: "mention",
+				Text: post.UserName + " mentioned you",
+				Link: "/post/" + post.Id,
+			})
+		}
+	}
+}
+
+// getMentionPosts returns the posts mentioning the user, the latest first.
+func (helper *DBHelper) getMentionPosts(userId string, viewerId string, start int64, count int64) ([]*Post, int64) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var (
+		values []string
+		length int64
+	)
+	values, helper.err = redis.Strings(redisConn.Do("LRANGE", "mentions:"+userId, start, start+count-1))
+	posts := []*Post{}
+
+	for _, postId := range values {
+		post := helper.getPost(postId)
+		if post.UserId == "" {
+			continue
+		}
+		post.Time = strElapsed(post.Time)
+		posts = append(posts, post)
+	}
+
+	length, helper.err = redis.Int64(redisConn.Do("LLEN", "mentions:"+userId))
+	helper.loadPostStats(posts, viewerId)
+	if helper.err != nil {
+		return posts, 0
+	}
+	return posts, length - start - int64(len(values))
+}
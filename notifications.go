@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/context"
+)
+
+// Notifications are kept newest first in the notifications:<userId> list as
+// JSON, capped at notificationsSize, and notifications_unread:<userId> counts
+// the ones the user hasn't seen yet.
+
+const notificationsSize = 200
+
+type Notification struct {
+	Kind string `json:"kind"`
+	Text string `json:"text"`
+	Link string `json:"link,omitempty"`
+	Time int64  `json:"time"`
+	Read bool   `json:"-"`
+}
+
+func (n *Notification) Elapsed() string {
+	return strElapsed(strconv.FormatInt(n.Time, 10))
+}
+
+func (helper *DBHelper) notify(userId string, n *Notification) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	n.Time = time.Now().Unix()
+	var data []byte
+	data, helper.err = json.Marshal(n)
+	if helper.err != nil {
+		return
+	}
+
+	redisConn.Send("MULTI")
+	redisConn.Send("LPUSH", "notifications:"+userId, data)
+	redisConn.Send("LTRIM", "notifications:"+userId, 0, notificationsSize-1)
+	redisConn.Send("INCR", "notifications_unread:"+userId)
+	_, helper.err = redisConn.Do("EXEC")
+}
+
+func (helper *DBHelper) unreadNotifications(userId string) int {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var count int
+	count, helper.err = redis.Int(redisConn.Do("GET", "notifications_unread:"+userId))
+	if helper.err == redis.ErrNil {
+		helper.err = nil
+	}
+	if count > notificationsSize {
+		count = notificationsSize
+	}
+	return count
+}
+
+func (helper *DBHelper) getNotifications(userId string, start int64, count int64) ([]*Notification, int64) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var (
+		values [][]byte
+		length int64
+	)
+	values, helper.err = redis.ByteSlices(redisConn.Do("LRANGE", "notifications:"+userId, start, start+count-1))
+	if helper.err != nil {
+		return nil, 0
+	}
+
+	notifications := []*Notification{}
+	for _, value := range values {
+		n := &Notification{}
+		if json.Unmarshal(value, n) == nil {
+			notifications = append(notifications, n)
+		}
+	}
+
+	length, helper.err = redis.Int64(redisConn.Do("LLEN", "notifications:"+userId))
+	if helper.err != nil {
+		return notifications, 0
+	}
+	return notifications, length - start - int64(len(values))
+}
+
+// markNotificationsRead returns how many notifications were unread.
+func (helper *DBHelper) markNotificationsRead(userId string) int {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var unread int
+	unread, helper.err = redis.Int(redisConn.Do("GETSET", "notifications_unread:"+userId, 0))
+	if helper.err == redis.ErrNil {
+		helper.err = nil
+	}
+	return unread
+}
+
+// UnreadNotifications is shown next to the link in the navbar.
+func (u *User) UnreadNotifications() int {
+	helper := DBHelper{}
+	count := helper.unreadNotifications(u.UserId)
+	if helper.err != nil {
+		log.Printf("err in count notifications %v", helper.err)
+	}
+	return count
+}
+
+// Notification Handlers
+
+func notificationsHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	start, err := strconv.ParseInt(r.FormValue("start"), 10, 64)
+	if err != nil || start < 0 {
+		start = 0
+	}
+
+	unread := int64(helper.markNotificationsRead(user.UserId))
+	notifications, rest := helper.getNotifications(user.UserId, start, 20)
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+
+	for i, n := range notifications {
+		n.Read = start+int64(i) >= unread
+	}
+
+	templateParams := map[string]interface{}{}
+	templateParams["user"] = user
+	templateParams["notifications"] = notifications
+	if start > 0 {
+		templateParams["prev"] = start - 20
+	}
+	if rest > 0 {
+		templateParams["next"] = start + 20
+	}
+
+	tmplRender.HTML(w, http.StatusOK, "notifications", templateParams)
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/context"
+)
+
+// OAuth 2.0 authorization server (RFC 6749). Only the authorization code
+// grant is supported and every client has to use PKCE (RFC 7636) with S256.
+
+const (
+	oauthCodeTTL    = 10 * 60
+	oauthAccessTTL  = 60 * 60
+	oauthRefreshTTL = 30 * 24 * 60 * 60
+)
+
+var oauthScopes = map[string]string{
+	"read":  "Read your profile and your home timeline",
+	"write": "Publish posts on your behalf",
+}
+
+type OAuthClient struct {
+	ClientId    string `redis:"clientId"`
+	Name        string `redis:"name"`
+	Secret      string `redis:"secret"`
+	RedirectURI string `redis:"redirectUri"`
+	OwnerId     string `redis:"ownerId"`
+}
+
+func (c *OAuthClient) IsPublic() bool {
+	return c.Secret == ""
+}
+
+// OAuthGrant is what an authorization code, access token or refresh token
+// stands for. The tokens themselves are only stored hashed.
+type OAuthGrant struct {
+	ClientId    string `redis:"clientId"`
+	UserId      string `redis:"userId"`
+	Scope       string `redis:"scope"`
+	RedirectURI string `redis:"redirectUri"`
+	Challenge   string `redis:"challenge"`
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+}
+
+type oauthError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func writeOAuthError(w http.ResponseWriter, status int, code string, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(oauthError{code, description})
+}
+
+func hasScope(granted string, scope string) bool {
+	for _, s := range strings.Fields(granted) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func validScope(scope string) bool {
+	for _, s := range strings.Fields(scope) {
+		if _, ok := oauthScopes[s]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func verifyPKCE(verifier string, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
+
+func (helper *DBHelper) registerClient(ownerId string, name string, redirectURI string, confidential bool) (*OAuthClient, string) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	client := &OAuthClient{
+		ClientId:    randomToken(16),
+		Name:        name,
+		RedirectURI: redirectURI,
+		OwnerId:     ownerId,
+	}
+	secret := ""
+	if confidential {
+		secret = randomToken(32)
+		client.Secret = hashToken(secret)
+	}
+
+	_, helper.err = redisConn.Do("HMSET", redis.Args{}.Add("oauth_client:"+client.ClientId).AddFlat(client)...)
+	if helper.err != nil {
+		return nil, ""
+	}
+	_, helper.err = redisConn.Do("SADD", "oauth_clients:"+ownerId, client.ClientId)
+	return client, secret
+}
+
+func (helper *DBHelper) getClient(clientId string) *OAuthClient {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var values []interface{}
+	values, helper.err = redis.Values(redisConn.Do("HGETALL", "oauth_client:"+clientId))
+	if helper.err != nil || len(values) == 0 {
+		return nil
+	}
+	client := &OAuthClient{}
+	helper.err = redis.ScanStruct(values, client)
+	if helper.err != nil {
+		return nil
+	}
+	return client
+}
+
+func (helper *DBHelper) getUserClients(userId string) []*OAuthClient {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var (
+		values  []string
+		clients = []*OAuthClient{}
+	)
+	values, helper.err = redis.Strings(redisConn.Do("SMEMBERS", "oauth_clients:"+userId))
+
+	for _, clientId := range values {
+		if client := helper.getClient(clientId); client != nil {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+func (helper *DBHelper) saveGrant(prefix string, token string, grant *OAuthGrant, ttl int) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	key := prefix + hashToken(token)
+	redisConn.Send("MULTI")
+	redisConn.Send("HMSET", redis.Args{}.Add(key).AddFlat(grant)...)
+	redisConn.Send("EXPIRE", key, ttl)
+	_, helper.err = redisConn.Do("EXEC")
+}
+
+func (helper *DBHelper) getGrant(prefix string, token string) *OAuthGrant {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var values []interface{}
+	values, helper.err = redis.Values(redisConn.Do("HGETALL", prefix+hashToken(token)))
+	if helper.err != nil || len(values) == 0 {
+		return nil
+	}
+	grant := &OAuthGrant{}
+	helper.err = redis.ScanStruct(values, grant)
+	if helper.err != nil {
+		return nil
+	}
+	return grant
+}
+
+// takeGrant reads and deletes a grant in one transaction so that codes and
+// refresh tokens can only be redeemed once.
+func (helper *DBHelper) takeGrant(prefix string, token string) *OAuthGrant {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	key := prefix + hashToken(token)
+	redisConn.Send("MULTI")
+	redisConn.Send("HGETALL", key)
+	redisConn.Send("DEL", key)
+
+	var (
+		replies []interface{}
+		values  []interface{}
+	)
+	replies, helper.err = redis.Values(redisConn.Do("EXEC"))
+	if helper.err != nil {
+		return nil
+	}
+	values, helper.err = redis.Values(replies[0], nil)
+	if helper.err != nil || len(values) == 0 {
+		return nil
+	}
+	grant := &OAuthGrant{}
+	helper.err = redis.ScanStruct(values, grant)
+	if helper.err != nil {
+		return nil
+	}
+	return grant
+}
+
+func (helper *DBHelper) issueTokens(grant *OAuthGrant) *tokenResponse {
+	access := randomToken(32)
+	refresh := randomToken(32)
+
+	tokenGrant := &OAuthGrant{ClientId: grant.ClientId, UserId: grant.UserId, Scope: grant.Scope}
+	helper.saveGrant("oauth_access:", access, tokenGrant, oauthAccessTTL)
+	if helper.err != nil {
+		return nil
+	}
+	helper.saveGrant("oauth_refresh:", refresh, tokenGrant, oauthRefreshTTL)
+	if helper.err != nil {
+		return nil
+	}
+	return &tokenResponse{access, "Bearer", oauthAccessTTL, refresh, grant.Scope}
+}
+
+// authenticateClient accepts HTTP Basic credentials or client_id and
+// client_secret form fields. Public clients only send their client_id.
+func (helper *DBHelper) authenticateClient(r *http.Request) *OAuthClient {
+	clientId, secret, ok := r.BasicAuth()
+	if !ok {
+		clientId = r.PostFormValue("client_id")
+		secret = r.PostFormValue("client_secret")
+	}
+	if clientId == "" {
+		return nil
+	}
+
+	client := helper.getClient(clientId)
+	if client == nil {
+		return nil
+	}
+	if client.IsPublic() {
+		if secret != "" {
+			return nil
+		}
+		return client
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(client.Secret)) != 1 {
+		return nil
+	}
+	return client
+}
+
+type authorizeRequest struct {
+	Client        *OAuthClient
+	RedirectURI   string
+	Scope         string
+	State         string
+	CodeChallenge string
+}
+
+func (req *authorizeRequest) redirect(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	u, _ := url.Parse(req.RedirectURI)
+	q := u.Query()
+	for k, v := range params {
+		q.Set(k, v)
+	}
+	if req.State != "" {
+		q.Set("state", req.State)
+	}
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// parseAuthorizeRequest returns an error when the client or the redirect uri
+// can't be trusted, in which case we must not redirect back. Problems with the
+// remaining parameters are reported to the client through the redirect.
+func parseAuthorizeRequest(r *http.Request) (*authorizeRequest, string, error) {
+	helper := DBHelper{}
+	client := helper.getClient(r.FormValue("client_id"))
+	if client == nil {
+		return nil, "", errors.New("Unknown OAuth client.")
+	}
+
+	req := &authorizeRequest{
+		Client:        client,
+		RedirectURI:   client.RedirectURI,
+		Scope:         strings.Join(strings.Fields(r.FormValue("scope")), " "),
+		State:         r.FormValue("state"),
+		CodeChallenge: r.FormValue("code_challenge"),
+	}
+	if redirectURI := r.FormValue("redirect_uri"); redirectURI != "" && redirectURI != client.RedirectURI {
+		return nil, "", errors.New("The redirect uri doesn't match the one registered for this client.")
+	}
+
+	if r.FormValue("response_type") != "code" {
+		return req, "unsupported_response_type", nil
+	}
+	if req.Scope == "" {
+		req.Scope = "read"
+	}
+	if !validScope(req.Scope) {
+		return req, "invalid_scope", nil
+	}
+	if r.FormValue("code_challenge_method") != "S256" || len(req.CodeChallenge) != 43 {
+		return req, "invalid_request", nil
+	}
+	return req, "", nil
+}
+
+// OAuth Handlers
+
+func oauthClientsHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	templateParams := map[string]interface{}{}
+	templateParams["user"] = user
+	templateParams["clients"] = helper.getUserClients(user.UserId)
+	templateParams["csrf"] = csrfToken(user.UserId, "oauth_clients")
+
+	tmplRender.HTML(w, http.StatusOK, "oauth_clients", templateParams)
+}
+
+func oauthRegisterClientHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	if !checkCSRF(r, user.UserId, "oauth_clients") {
+		Goback(w, r, errors.New("Your session has expired, please reload the page."))
+		return
+	}
+
+	name := strings.TrimSpace(r.PostFormValue("name"))
+	redirectURI := r.PostFormValue("redirect_uri")
+	if name == "" || redirectURI == "" {
+		Goback(w, r, errors.New("Both the application name and the redirect uri are needed!"))
+		return
+	}
+
+	u, err := url.Parse(redirectURI)
+	if err != nil || !u.IsAbs() || u.Fragment != "" {
+		Goback(w, r, errors.New("The redirect uri must be an absolute uri without a fragment."))
+		return
+	}
+
+	client, secret := helper.registerClient(user.UserId, name, redirectURI, r.PostFormValue("type") == "confidential")
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+
+	templateParams := map[string]interface{}{}
+	templateParams["user"] = user
+	templateParams["client"] = client
+	templateParams["secret"] = secret
+	templateParams["clients"] = helper.getUserClients(user.UserId)
+	templateParams["csrf"] = csrfToken(user.UserId, "oauth_clients")
+
+	tmplRender.HTML(w, http.StatusOK, "oauth_clients", templateParams)
+}
+
+func oauthAuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	req, errCode, err := parseAuthorizeRequest(r)
+	if err != nil {
+		Goback(w, r, err)
+		return
+	}
+	if errCode != "" {
+		req.redirect(w, r, map[string]string{"error": errCode})
+		return
+	}
+
+	user, _ := context.Get(r, "user").(*User)
+	if user == nil {
+		tmplRender.HTML(w, http.StatusOK, "welcome", welcomeParams(r.URL.RequestURI()))
+		return
+	}
+
+	scopes := []string{}
+	for _, s := range strings.Fields(req.Scope) {
+		scopes = append(scopes, oauthScopes[s])
+	}
+
+	templateParams := map[string]interface{}{}
+	templateParams["user"] = user
+	templateParams["request"] = req
+	templateParams["scopes"] = scopes
+	templateParams["csrf"] = csrfToken(user.UserId, "oauth_consent:"+req.Client.ClientId)
+
+	tmplRender.HTML(w, http.StatusOK, "consent", templateParams)
+}
+
+func oauthConsentHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	req, errCode, err := parseAuthorizeRequest(r)
+	if err != nil {
+		Goback(w, r, err)
+		return
+	}
+	if errCode != "" {
+		req.redirect(w, r, map[string]string{"error": errCode})
+		return
+	}
+
+	user := context.Get(r, "user").(*User)
+	if !checkCSRF(r, user.UserId, "oauth_consent:"+req.Client.ClientId) {
+		Goback(w, r, errors.New("Your session has expired, please reload the page."))
+		return
+	}
+
+	if r.PostFormValue("approve") == "" {
+		req.redirect(w, r, map[string]string{"error": "access_denied"})
+		return
+	}
+
+	code := randomToken(32)
+	grant := &OAuthGrant{
+		ClientId:    req.Client.ClientId,
+		UserId:      user.UserId,
+		Scope:       req.Scope,
+		RedirectURI: req.RedirectURI,
+		Challenge:   req.CodeChallenge,
+	}
+	helper.saveGrant("oauth_code:", code, grant, oauthCodeTTL)
+	if helper.err != nil {
+		req.redirect(w, r, map[string]string{"error": "server_error"})
+		return
+	}
+
+	req.redirect(w, r, map[string]string{"code": code})
+}
+
+func oauthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+
+	client := helper.authenticateClient(r)
+	if client == nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="SimpleGo"`)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed.")
+		return
+	}
+
+	var grant *OAuthGrant
+	switch r.PostFormValue("grant_type") {
+	case "authorization_code":
+		grant = helper.takeGrant("oauth_code:", r.PostFormValue("code"))
+		if grant == nil || grant.ClientId != client.ClientId {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "The authorization code is invalid or expired.")
+			return
+		}
+		if redirectURI := r.PostFormValue("redirect_uri"); redirectURI != "" && redirectURI != grant.RedirectURI {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "The redirect uri doesn't match.")
+			return
+		}
+		if !verifyPKCE(r.PostFormValue("code_verifier"), grant.Challenge) {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "The code verifier doesn't match.")
+			return
+		}
+	case "refresh_token":
+		grant = helper.takeGrant("oauth_refresh:", r.PostFormValue("refresh_token"))
+		if grant == nil || grant.ClientId != client.ClientId {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "The refresh token is invalid or expired.")
+			return
+		}
+		if scope := r.PostFormValue("scope"); scope != "" {
+			for _, s := range strings.Fields(scope) {
+				if !hasScope(grant.Scope, s) {
+					writeOAuthError(w, http.StatusBadRequest, "invalid_scope", "The requested scope exceeds the granted scope.")
+					return
+				}
+			}
+			grant.Scope = strings.Join(strings.Fields(scope), " ")
+		}
+	default:
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "")
+		return
+	}
+
+	token := helper.issueTokens(grant)
+	if helper.err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	json.NewEncoder(w).Encode(token)
+}
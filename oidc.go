@@ -0,0 +1,551 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// OpenID Connect relying party. Users can sign in with an external identity
+// provider; the issuer and subject of the ID token are linked to a User in
+// the oidc_subjects hash. The link is claimed with an empty user id before
+// the account is created, so two first logins can't both create one.
+
+const oidcSessionName = "OIDC"
+
+var (
+	oidcIssuer       = flag.String("oidcIssuer", "", "issuer url of the OpenID Connect provider, empty to disable")
+	oidcClientId     = flag.String("oidcClientId", "", "")
+	oidcClientSecret = flag.String("oidcClientSecret", "", "")
+	oidcName         = flag.String("oidcName", "your company account", "name of the provider shown on the login page")
+
+	oidcClient = &http.Client{Timeout: 10 * time.Second}
+	oidc       = &OIDCProvider{}
+)
+
+func oidcEnabled() bool {
+	return *oidcIssuer != ""
+}
+
+func oidcRedirectURI() string {
+	return strings.TrimRight(*baseURL, "/") + "/login/oidc/callback"
+}
+
+type OIDCProvider struct {
+	sync.Mutex
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	keys                  map[string]crypto.PublicKey
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if json.Unmarshal(b, &s) == nil {
+		*a = audience{s}
+		return nil
+	}
+	var l []string
+	if err := json.Unmarshal(b, &l); err != nil {
+		return err
+	}
+	*a = audience(l)
+	return nil
+}
+
+func (a audience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+type IDToken struct {
+	Issuer            string   `json:"iss"`
+	Subject           string   `json:"sub"`
+	Audience          audience `json:"aud"`
+	AuthorizedParty   string   `json:"azp"`
+	Expiry            int64    `json:"exp"`
+	IssuedAt          int64    `json:"iat"`
+	Nonce             string   `json:"nonce"`
+	PreferredUsername string   `json:"preferred_username"`
+	Email             string   `json:"email"`
+	EmailVerified     bool     `json:"email_verified"`
+}
+
+func fetchJSON(u string, v interface{}) error {
+	resp, err := oidcClient.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// discover loads the provider metadata once; a failed discovery is retried
+// on the next login.
+func (p *OIDCProvider) discover() error {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.TokenEndpoint != "" {
+		return nil
+	}
+
+	issuer := strings.TrimRight(*oidcIssuer, "/")
+	if err := fetchJSON(issuer+"/.well-known/openid-configuration", p); err != nil {
+		return err
+	}
+	if strings.TrimRight(p.Issuer, "/") != issuer {
+		p.TokenEndpoint = ""
+		return errors.New("the provider reported a different issuer")
+	}
+	if p.AuthorizationEndpoint == "" || p.TokenEndpoint == "" || p.JWKSURI == "" {
+		p.TokenEndpoint = ""
+		return errors.New("incomplete provider metadata")
+	}
+	return nil
+}
+
+func (p *OIDCProvider) loadKeys() error {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := fetchJSON(p.JWKSURI, &set); err != nil {
+		return err
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			if err1 != nil || err2 != nil || k.Crv != "P-256" {
+				continue
+			}
+			key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if !key.Curve.IsOnCurve(key.X, key.Y) {
+				continue
+			}
+			keys[k.Kid] = key
+		}
+	}
+
+	p.Lock()
+	p.keys = keys
+	p.Unlock()
+	return nil
+}
+
+func (p *OIDCProvider) key(kid string) crypto.PublicKey {
+	p.Lock()
+	key := p.keys[kid]
+	p.Unlock()
+
+	if key == nil {
+		// The provider may have rotated its keys.
+		if p.loadKeys() != nil {
+			return nil
+		}
+		p.Lock()
+		key = p.keys[kid]
+		p.Unlock()
+	}
+	return key
+}
+
+// verify checks the signature and the claims of an ID token as described in
+// section 3.1.3.7 of OpenID Connect Core.
+func (p *OIDCProvider) verify(rawToken string, nonce string) (*IDToken, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed id token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(b, &header) != nil {
+		return nil, errors.New("malformed id token header")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed id token signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	switch key := p.key(header.Kid).(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+			return nil, errors.New("invalid id token signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(signature) != 64 {
+			return nil, errors.New("invalid id token signature")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(key, digest[:], r, s) {
+			return nil, errors.New("invalid id token signature")
+		}
+	default:
+		return nil, errors.New("unknown id token signing key")
+	}
+
+	token := &IDToken{}
+	b, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(b, token) != nil {
+		return nil, errors.New("malformed id token claims")
+	}
+
+	now := time.Now().Unix()
+	switch {
+	case token.Issuer != p.Issuer:
+		return nil, errors.New("id token issued by another provider")
+	case !token.Audience.contains(*oidcClientId):
+		return nil, errors.New("id token issued for another client")
+	case len(token.Audience) > 1 && token.AuthorizedParty != *oidcClientId:
+		return nil, errors.New("id token issued for another client")
+	case token.Expiry < now-60:
+		return nil, errors.New("id token expired")
+	case token.IssuedAt > now+60:
+		return nil, errors.New("id token issued in the future")
+	case token.Nonce != nonce:
+		return nil, errors.New("id token nonce doesn't match")
+	case token.Subject == "":
+		return nil, errors.New("id token without subject")
+	}
+	return token, nil
+}
+
+func (p *OIDCProvider) exchange(code string, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {oidcRedirectURI()},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest("POST", p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(*oidcClientId), url.QueryEscape(*oidcClientSecret))
+
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK || body.IDToken == "" {
+		return "", fmt.Errorf("token request failed: %s %s", resp.Status, body.Error)
+	}
+	return body.IDToken, nil
+}
+
+func (helper *DBHelper) getLinkedUser(issuer string, subject string) string {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var userId string
+	userId, helper.err = redis.String(redisConn.Do("HGET", "oidc_subjects", issuer+" "+subject))
+	if helper.err == redis.ErrNil {
+		helper.err = nil
+	}
+	return userId
+}
+
+// claimSubject reserves the identity for the account about to be created for
+// it and reports whether it was still free.
+func (helper *DBHelper) claimSubject(issuer string, subject string) bool {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var claimed bool
+	claimed, helper.err = redis.Bool(redisConn.Do("HSETNX", "oidc_subjects", issuer+" "+subject, ""))
+	return claimed
+}
+
+// releaseSubject gives up the claim when the account couldn't be created.
+func (helper *DBHelper) releaseSubject(issuer string, subject string) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	_, helper.err = redisConn.Do("HDEL", "oidc_subjects", issuer+" "+subject)
+}
+
+// linkUser links the claimed identity to the new account.
+func (helper *DBHelper) linkUser(issuer string, subject string, userId string) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	_, helper.err = redisConn.Do("HSET", "oidc_subjects", issuer+" "+subject, userId)
+}
+
+// OIDC Handlers
+
+func oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if !oidcEnabled() {
+		WriteError(w, ErrNotFound)
+		return
+	}
+
+	if err := oidc.discover(); err != nil {
+		Goback(w, r, fmt.Errorf("The identity provider is not available: %v", err))
+		return
+	}
+
+	session, _ := redisStore.Get(r, oidcSessionName)
+	state := randomToken(16)
+	nonce := randomToken(16)
+	verifier := randomToken(32)
+	session.Values["state"] = state
+	session.Values["nonce"] = nonce
+	session.Values["verifier"] = verifier
+	session.Values["next"] = localPath(r.FormValue("next"))
+	saveSession(r, w)
+
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {*oidcClientId},
+		"redirect_uri":          {oidcRedirectURI()},
+		"scope":                 {"openid profile email"},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	u, _ := url.Parse(oidc.AuthorizationEndpoint)
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	if !oidcEnabled() {
+		WriteError(w, ErrNotFound)
+		return
+	}
+
+	session, _ := redisStore.Get(r, oidcSessionName)
+	state, _ := session.Values["state"].(string)
+	nonce, _ := session.Values["nonce"].(string)
+	verifier, _ := session.Values["verifier"].(string)
+	next, _ := session.Values["next"].(string)
+	delete(session.Values, "state")
+	delete(session.Values, "nonce")
+	delete(session.Values, "verifier")
+	saveSession(r, w)
+
+	if state == "" || r.FormValue("state") != state {
+		Goback(w, r, errors.New("The login request has expired, please try again."))
+		return
+	}
+
+	if e := r.FormValue("error"); e != "" {
+		Goback(w, r, fmt.Errorf("The identity provider refused the login: %s", e))
+		return
+	}
+
+	if err := oidc.discover(); err != nil {
+		Goback(w, r, fmt.Errorf("The identity provider is not available: %v", err))
+		return
+	}
+
+	rawToken, err := oidc.exchange(r.FormValue("code"), verifier)
+	if err != nil {
+		Goback(w, r, err)
+		return
+	}
+
+	token, err := oidc.verify(rawToken, nonce)
+	if err != nil {
+		Goback(w, r, err)
+		return
+	}
+
+	userId := helper.getLinkedUser(token.Issuer, token.Subject)
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+
+	if userId != "" {
+		loginSucceeded(userId, *oidcName, false, r, w)
+		http.Redirect(w, r, localPath(next), http.StatusFound)
+		return
+	}
+
+	// First login with this identity, the user has to pick a username.
+	session.Values["issuer"] = token.Issuer
+	session.Values["subject"] = token.Subject
+	session.Values["email"] = token.Email
+	session.Values["emailVerified"] = token.EmailVerified
+	saveSession(r, w)
+
+	templateParams := map[string]interface{}{}
+	templateParams["username"] = token.PreferredUsername
+	templateParams["provider"] = *oidcName
+	templateParams["registration"] = *registrationMode
+	tmplRender.HTML(w, http.StatusOK, "oidc_register", templateParams)
+}
+
+func oidcRegisterHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+
+	session, _ := redisStore.Get(r, oidcSessionName)
+	issuer, _ := session.Values["issuer"].(string)
+	subject, _ := session.Values["subject"].(string)
+	email, _ := session.Values["email"].(string)
+	emailVerified, _ := session.Values["emailVerified"].(bool)
+	next, _ := session.Values["next"].(string)
+	if issuer == "" || subject == "" {
+		Goback(w, r, errors.New("The login request has expired, please try again."))
+		return
+	}
+
+	userName := r.PostFormValue("username")
+	if userName == "" {
+		Goback(w, r, errors.New("You need to choose a username!"))
+		return
+	}
+
+	userName, err := parseUserName(userName)
+	if err != nil {
+		Goback(w, r, err)
+		return
+	}
+
+	// Another registration with the identity may have been faster, its
+	// account is the one to sign in to.
+	if !helper.claimSubject(issuer, subject) {
+		userId := helper.getLinkedUser(issuer, subject)
+		if helper.err != nil {
+			Goback(w, r, helper.err)
+			return
+		}
+		if userId == "" {
+			Goback(w, r, errors.New("The account is being created, please sign in again in a moment."))
+			return
+		}
+		session.Options.MaxAge = -1
+		saveSession(r, w)
+
+		loginSucceeded(userId, *oidcName, false, r, w)
+		http.Redirect(w, r, localPath(next), http.StatusFound)
+		return
+	}
+
+	inviterId := helper.admitRegistration(r)
+	if helper.err != nil {
+		err := helper.err
+		helper.releaseSubject(issuer, subject)
+		Goback(w, r, err)
+		return
+	}
+
+	// Accounts created this way have no password and can only sign in
+	// through the identity provider.
+	userId := helper.createUser(userName, "")
+	if helper.err != nil {
+		err := helper.err
+		helper.releaseSubject(issuer, subject)
+		if inviterId != "" {
+			helper.restoreInvite(inviterId, strings.TrimSpace(r.PostFormValue("invite")))
+		}
+		Goback(w, r, err)
+		return
+	}
+
+	if inviterId != "" {
+		helper.recordInvite(inviterId, userId)
+	}
+
+	helper.linkUser(issuer, subject, userId)
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+
+	// The address is only a convenience here, the account works without it.
+	if email != "" {
+		helper.setEmail(&User{UserId: userId}, email)
+		if helper.err != nil {
+			log.Printf("err in set email %v", helper.err)
+		} else if emailVerified {
+			helper.markEmailVerified(userId)
+		}
+	}
+
+	session.Options.MaxAge = -1
+	saveSession(r, w)
+
+	setSession(userId, false, r, w)
+	helper.rememberDevice(userId, deviceId(r, w))
+	http.Redirect(w, r, localPath(next), http.StatusFound)
+}
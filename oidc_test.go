@@ -0,0 +1,311 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testProvider is a stand-in OpenID Connect provider with discovery, its
+// signing keys and a token endpoint handing out the ID token the test set.
+type testProvider struct {
+	sync.Mutex
+	server    *httptest.Server
+	keys      map[string]*rsa.PrivateKey
+	keyLoads  int
+	challenge string
+	idToken   string
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	p := &testProvider{keys: map[string]*rsa.PrivateKey{}}
+	p.addKey("key-1")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.server.URL,
+			"authorization_endpoint": p.server.URL + "/authorize",
+			"token_endpoint":         p.server.URL + "/token",
+			"jwks_uri":               p.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		p.Lock()
+		defer p.Unlock()
+
+		p.keyLoads++
+		keys := []*jsonWebKey{}
+		for kid, key := range p.keys {
+			keys = append(keys, &jsonWebKey{
+				Kty: "RSA",
+				Kid: kid,
+				Use: "sig",
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		p.Lock()
+		defer p.Unlock()
+
+		clientId, secret, _ := r.BasicAuth()
+		verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if clientId != "simplego" || secret != "secret" || r.PostFormValue("code") != "code" ||
+			base64.RawURLEncoding.EncodeToString(verifier[:]) != p.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": p.idToken})
+	})
+	p.server = httptest.NewServer(mux)
+
+	*oidcIssuer, *oidcClientId, *oidcClientSecret = p.server.URL, "simplego", "secret"
+	oidc = &OIDCProvider{}
+	t.Cleanup(func() {
+		p.server.Close()
+		*oidcIssuer, *oidcClientId, *oidcClientSecret = "", "", ""
+		oidc = &OIDCProvider{}
+	})
+	return p
+}
+
+func (p *testProvider) addKey(kid string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	p.Lock()
+	p.keys[kid] = key
+	p.Unlock()
+}
+
+func (p *testProvider) claims(subject string, nonce string) map[string]interface{} {
+	now := time.Now().Unix()
+	return map[string]interface{}{
+		"iss":   p.server.URL,
+		"sub":   subject,
+		"aud":   "simplego",
+		"exp":   now + 300,
+		"iat":   now,
+		"nonce": nonce,
+	}
+}
+
+// sign signs the claims with the key, which doesn't have to be published.
+func (p *testProvider) sign(alg string, kid string, claims map[string]interface{}) string {
+	p.Lock()
+	key := p.keys[kid]
+	p.Unlock()
+	if key == nil {
+		key, _ = rsa.GenerateKey(rand.Reader, 2048)
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestOIDCVerify(t *testing.T) {
+	p := newTestProvider(t)
+	if err := oidc.discover(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		alg    string
+		kid    string
+		change func(claims map[string]interface{})
+		ok     bool
+	}{
+		{"valid", "RS256", "key-1", func(map[string]interface{}) {}, true},
+		{"wrong issuer", "RS256", "key-1", func(c map[string]interface{}) { c["iss"] = "https://evil.example" }, false},
+		{"wrong audience", "RS256", "key-1", func(c map[string]interface{}) { c["aud"] = "other" }, false},
+		{"several audiences", "RS256", "key-1", func(c map[string]interface{}) {
+			c["aud"], c["azp"] = []string{"simplego", "other"}, "simplego"
+		}, true},
+		{"several audiences without azp", "RS256", "key-1", func(c map[string]interface{}) {
+			c["aud"] = []string{"simplego", "other"}
+		}, false},
+		{"azp of another client", "RS256", "key-1", func(c map[string]interface{}) {
+			c["aud"], c["azp"] = []string{"simplego", "other"}, "other"
+		}, false},
+		{"expired", "RS256", "key-1", func(c map[string]interface{}) { c["exp"] = time.Now().Unix() - 120 }, false},
+		{"issued in the future", "RS256", "key-1", func(c map[string]interface{}) { c["iat"] = time.Now().Unix() + 120 }, false},
+		{"nonce mismatch", "RS256", "key-1", func(c map[string]interface{}) { c["nonce"] = "other" }, false},
+		{"no subject", "RS256", "key-1", func(c map[string]interface{}) { delete(c, "sub") }, false},
+		{"wrong alg", "HS256", "key-1", func(map[string]interface{}) {}, false},
+		{"alg none", "none", "key-1", func(map[string]interface{}) {}, false},
+		{"unknown key", "RS256", "key-0", func(map[string]interface{}) {}, false},
+	}
+
+	for _, test := range tests {
+		claims := p.claims("subject", "nonce")
+		test.change(claims)
+		token, err := oidc.verify(p.sign(test.alg, test.kid, claims), "nonce")
+		if test.ok && (err != nil || token.Subject != "subject") {
+			t.Errorf("%s: got %+v, %v", test.name, token, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: accepted", test.name)
+		}
+	}
+
+	// A corrupted signature doesn't verify either.
+	token := p.sign("RS256", "key-1", p.claims("subject", "nonce"))
+	if _, err := oidc.verify(token[:len(token)-4]+"AAAA", "nonce"); err == nil {
+		t.Error("bad signature accepted")
+	}
+}
+
+func TestOIDCKeyRotation(t *testing.T) {
+	p := newTestProvider(t)
+	if err := oidc.discover(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := oidc.verify(p.sign("RS256", "key-1", p.claims("subject", "nonce")), "nonce"); err != nil {
+		t.Fatal(err)
+	}
+	loads := p.keyLoads
+
+	// A token signed with a key published since makes the keys load again.
+	p.addKey("key-2")
+	if _, err := oidc.verify(p.sign("RS256", "key-2", p.claims("subject", "nonce")), "nonce"); err != nil {
+		t.Fatalf("rotated key: %v", err)
+	}
+	if p.keyLoads != loads+1 {
+		t.Errorf("keys loaded %d times, want %d", p.keyLoads, loads+1)
+	}
+	if _, err := oidc.verify(p.sign("RS256", "key-1", p.claims("subject", "nonce")), "nonce"); err != nil {
+		t.Errorf("old key: %v", err)
+	}
+	if p.keyLoads != loads+1 {
+		t.Error("keys loaded again for a known key")
+	}
+}
+
+// oidcLogin runs the login up to the callback with the claims the provider
+// puts into the ID token.
+func oidcLogin(t *testing.T, p *testProvider, browser *testBrowser, claims map[string]interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	w := browser.get(oidcLoginHandler, "/login/oidc?next=/home")
+	location, err := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusFound || err != nil || !strings.HasPrefix(location.String(), p.server.URL+"/authorize") {
+		t.Fatalf("login: %d %q", w.Code, w.Header().Get("Location"))
+	}
+	query := location.Query()
+
+	claims["nonce"] = query.Get("nonce")
+	p.Lock()
+	p.challenge = query.Get("code_challenge")
+	p.Unlock()
+	p.idToken = p.sign("RS256", "key-1", claims)
+
+	return browser.get(oidcCallbackHandler, "/login/oidc/callback?code=code&state="+url.QueryEscape(query.Get("state")))
+}
+
+func TestOIDCFirstLogin(t *testing.T) {
+	setupRedis(t)
+	p := newTestProvider(t)
+
+	claims := p.claims("carol-at-idp", "")
+	claims["preferred_username"] = "carol"
+	claims["email"] = "carol@example.com"
+	claims["email_verified"] = true
+
+	browser := newTestBrowser()
+	w := oidcLogin(t, p, browser, claims)
+	if w.Code != http.StatusOK || browser.userId() != "" {
+		t.Fatalf("callback: %d, signed in as %q", w.Code, browser.userId())
+	}
+
+	w = browser.post(oidcRegisterHandler, "/login/oidc/register", url.Values{"username": {"carol"}})
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/home" {
+		t.Fatalf("register: %d %q", w.Code, w.Header().Get("Location"))
+	}
+	userId := browser.userId()
+	if userId == "" {
+		t.Fatal("not signed in after registering")
+	}
+
+	helper := DBHelper{}
+	user := helper.getUserFromName("carol")
+	if user == nil || user.UserId != userId || user.Password != "" {
+		t.Fatalf("got user %+v, %v", user, helper.err)
+	}
+	if user.Email != "carol@example.com" || !user.EmailVerified {
+		t.Errorf("email %q verified %v", user.Email, user.EmailVerified)
+	}
+	if linked := helper.getLinkedUser(p.server.URL, "carol-at-idp"); linked != userId {
+		t.Errorf("identity linked to %q, want %q", linked, userId)
+	}
+
+	// The next login goes straight to the linked account.
+	browser = newTestBrowser()
+	w = oidcLogin(t, p, browser, p.claims("carol-at-idp", ""))
+	if w.Code != http.StatusFound || browser.userId() != userId {
+		t.Fatalf("second login: %d, signed in as %q", w.Code, browser.userId())
+	}
+}
+
+func TestOIDCCallbackRejectsToken(t *testing.T) {
+	setupRedis(t)
+	p := newTestProvider(t)
+
+	claims := p.claims("carol-at-idp", "")
+	claims["aud"] = "other"
+
+	browser := newTestBrowser()
+	oidcLogin(t, p, browser, claims)
+	w := browser.post(oidcRegisterHandler, "/login/oidc/register", url.Values{"username": {"carol"}})
+	if browser.userId() != "" || w.Code == http.StatusFound {
+		t.Fatal("registered with a token for another client")
+	}
+}
+
+func TestOIDCRegisterLinkedMeanwhile(t *testing.T) {
+	setupRedis(t)
+	p := newTestProvider(t)
+
+	browser := newTestBrowser()
+	oidcLogin(t, p, browser, p.claims("carol-at-idp", ""))
+
+	// Another first login with the identity finished in the meantime.
+	daveId := createTestUser(t, "dave", "")
+	helper := DBHelper{}
+	if !helper.claimSubject(p.server.URL, "carol-at-idp") {
+		t.Fatal(helper.err)
+	}
+	helper.linkUser(p.server.URL, "carol-at-idp", daveId)
+
+	browser.post(oidcRegisterHandler, "/login/oidc/register", url.Values{"username": {"carol"}})
+	if userId := browser.userId(); userId != daveId {
+		t.Errorf("signed in as %q, want %q", userId, daveId)
+	}
+	if helper.getUserFromName("carol") != nil {
+		t.Error("created an account for the identity linked to another one")
+	}
+}
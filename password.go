@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The password policy asks for a minimum length and a rough entropy estimate,
+// and rejects passwords found in a breach corpus. The corpus is a file with
+// one password per line, or the SHA-1 hashes of the passwords in hex as in
+// the Pwned Passwords dumps ("HASH:count" lines work as well). It is loaded
+// into a Bloom filter so millions of passwords fit in a few megabytes.
+
+const passwordMaxLength = 256
+
+var (
+	passwordMinLength  = flag.Int("passwordMinLength", 10, "minimum number of characters of a password")
+	passwordMinEntropy = flag.Float64("passwordMinEntropy", 40, "minimum estimated entropy of a password in bits")
+	breachedFile       = flag.String("breachedPasswords", "", "file of breached passwords which are refused, one per line")
+	breachedFPRate     = flag.Float64("breachedFalsePositives", 0.001, "false positive rate of the breached password filter")
+
+	breachedPasswords *BloomFilter
+
+	ErrPasswordTooLong  = errors.New("Your password is too long.")
+	ErrPasswordWeak     = errors.New("Your password is too easy to guess, try a longer one mixing words, numbers and symbols.")
+	ErrPasswordName     = errors.New("Your password must not contain your username.")
+	ErrPasswordBreached = errors.New("This password has appeared in a data breach and can't be used, please choose another one.")
+)
+
+type BloomFilter struct {
+	bits []uint64
+	m    uint64
+	k    uint64
+}
+
+// NewBloomFilter sizes the filter for n keys at the given false positive
+// rate.
+func NewBloomFilter(n int, fpRate float64) *BloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &BloomFilter{make([]uint64, (m+63)/64), m, k}
+}
+
+// locations derives the k bit positions from two hashes of the key.
+func (f *BloomFilter) locations(key []byte) []uint64 {
+	sum := sha256.Sum256(key)
+	h1 := binary.BigEndian.Uint64(sum[0:8])
+	h2 := binary.BigEndian.Uint64(sum[8:16]) | 1
+
+	locations := make([]uint64, f.k)
+	for i := range locations {
+		locations[i] = (h1 + uint64(i)*h2) % f.m
+	}
+	return locations
+}
+
+func (f *BloomFilter) Add(key []byte) {
+	for _, l := range f.locations(key) {
+		f.bits[l/64] |= 1 << (l % 64)
+	}
+}
+
+func (f *BloomFilter) Test(key []byte) bool {
+	for _, l := range f.locations(key) {
+		if f.bits[l/64]&(1<<(l%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// breachKey turns a line of the corpus into the SHA-1 of the password.
+func breachKey(line string) []byte {
+	if i := strings.IndexByte(line, ':'); i == 40 {
+		line = line[:40]
+	}
+	if len(line) == 40 {
+		if key, err := hex.DecodeString(line); err == nil {
+			return key
+		}
+	}
+	return passwordKey(line)
+}
+
+func passwordKey(password string) []byte {
+	sum := sha1.Sum([]byte(password))
+	return sum[:]
+}
+
+func loadBreachedPasswords(name string) (*BloomFilter, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// The first pass counts the lines to size the filter.
+	count := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := file.Seek(0, 0); err != nil {
+		return nil, err
+	}
+
+	filter := NewBloomFilter(count, *breachedFPRate)
+	scanner = bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimRight(scanner.Text(), "\r"); line != "" {
+			filter.Add(breachKey(line))
+		}
+	}
+	return filter, scanner.Err()
+}
+
+func initPasswordPolicy() {
+	if *breachedFile == "" {
+		return
+	}
+
+	filter, err := loadBreachedPasswords(*breachedFile)
+	if err != nil {
+		log.Fatalf("err in load breached passwords %v", err)
+	}
+	breachedPasswords = filter
+	log.Printf("breached password filter uses %d KB", len(filter.bits)*8/1024)
+}
+
+// passwordEntropy estimates the entropy in bits from the kinds of characters
+// used. Repeated characters and runs like "abc" or "321" count for less.
+func passwordEntropy(password string) float64 {
+	var lower, upper, digit, symbol, other bool
+	seen := map[rune]bool{}
+	length := 0.0
+	prev := rune(-1)
+
+	for _, c := range password {
+		switch {
+		case c >= 'a' && c <= 'z':
+			lower = true
+		case c >= 'A' && c <= 'Z':
+			upper = true
+		case c >= '0' && c <= '9':
+			digit = true
+		case c < utf8.RuneSelf && unicode.IsPrint(c):
+			symbol = true
+		default:
+			other = true
+		}
+
+		switch {
+		case c == prev || c == prev+1 || c == prev-1:
+			length += 0.25
+		case seen[c]:
+			length += 0.5
+		default:
+			length += 1
+		}
+		seen[c] = true
+		prev = c
+	}
+
+	pool := 0
+	for _, class := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.used {
+			pool += class.size
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+	return length * math.Log2(float64(pool))
+}
+
+// checkPassword applies the password policy, userName may be empty when it
+// isn't known.
+func checkPassword(password string, userName string) error {
+	length := utf8.RuneCountInString(password)
+	if length < *passwordMinLength {
+		return fmt.Errorf("Your password needs at least %d characters.", *passwordMinLength)
+	}
+	if length > passwordMaxLength {
+		return ErrPasswordTooLong
+	}
+
+	if len(userName) >= 3 && strings.Contains(strings.ToLower(password), strings.ToLower(userName)) {
+		return ErrPasswordName
+	}
+
+	if passwordEntropy(password) < *passwordMinEntropy {
+		return ErrPasswordWeak
+	}
+
+	if breachedPasswords != nil && breachedPasswords.Test(passwordKey(password)) {
+		return ErrPasswordBreached
+	}
+	return nil
+}
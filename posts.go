@@ -0,0 +1,486 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/context"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Deleting a post removes post:<id> and takes it off the lists which are
+// cheap to fix right away. Its id stays in the posts:<userId> lists of the
+// followers until runPostSweeps removes every id in deleted_posts from them,
+// the lists skip missing posts meanwhile.
+//
+// An edit keeps the previous body in post_history:<id>, newest first. Every
+// version has the time it was written, which is the post time or the time of
+// the edit which replaced it.
+
+var (
+	editWindow = flag.Duration("editWindow", time.Hour, "how long after posting a post can be edited")
+
+	ErrPostNotFound = errors.New("This post doesn't exist.")
+	ErrNotAuthor    = errors.New("Only the author can change a post.")
+	ErrEditWindow   = errors.New("This post is too old to edit.")
+	ErrEmptyBody    = errors.New("The post must not be empty.")
+	ErrEditConflict = errors.New("The post was changed meanwhile, please try again.")
+)
+
+const (
+	postSweepInterval = time.Minute
+	postSweepLockTTL  = 10 * 60
+)
+
+type PostVersion struct {
+	Body string `json:"body"`
+	Time int64  `json:"time"`
+}
+
+func (v *PostVersion) Written() string {
+	return time.Unix(v.Time, 0).UTC().Format("January 2, 2006 15:04 MST")
+}
+
+func (p *Post) PostedTime() time.Time {
+	return time.Unix(p.Posted, 0)
+}
+
+func (p *Post) CanEdit() bool {
+	return p.RepostOf == "" && time.Since(p.PostedTime()) < *editWindow
+}
+
+// PostCard is what the post_card template shows: the post, who looks at it,
+// nil when nobody is logged in, and how the page places it.
+type PostCard struct {
+	*Post
+	User *User
+	// Thread is set on the conversation page, Focus for its main post.
+	Thread   bool
+	Focus    bool
+	Indent   int
+	Reactors []*Reaction
+}
+
+// Card returns the card of the post for the user of the page.
+func (p *Post) Card(user interface{}) *PostCard {
+	u, _ := user.(*User)
+	return &PostCard{Post: p, User: u}
+}
+
+func (c *PostCard) ViewerId() string {
+	if c.User == nil {
+		return ""
+	}
+	return c.User.UserId
+}
+
+func (c *PostCard) IsAuthor() bool {
+	return c.User != nil && c.User.UserId == c.UserId
+}
+
+// bodyLink links the part of the body from start to end.
+type bodyLink struct {
+	start, end  int
+	class, href string
+}
+
+// BodyHTML is the body with the mentions and hashtags linked.
+func (p *Post) BodyHTML() template.HTML {
+	links := append(p.mentionLinks(), p.tagLinks()...)
+	sort.Slice(links, func(i, j int) bool { return links[i].start < links[j].start })
+
+	html := ""
+	last := 0
+	for _, link := range links {
+		if link.start < last {
+			continue
+		}
+		html += template.HTMLEscapeString(p.Body[last:link.start])
+		html += `<a class="` + link.class + `" href="` + template.HTMLEscapeString(link.href) + `">` +
+			template.HTMLEscapeString(p.Body[link.start:link.end]) + `</a>`
+		last = link.end
+	}
+	html += template.HTMLEscapeString(p.Body[last:])
+	return template.HTML(html)
+}
+
+func (u *User) PostCSRF() string {
+	return csrfToken(u.UserId, "post")
+}
+
+// postParam loads the post named in the route.
+func (helper *DBHelper) postParam(r *http.Request) *Post {
+	params := context.Get(r, "params").(httprouter.Params)
+	postId := params.ByName("id")
+	if _, err := strconv.ParseUint(postId, 10, 64); err != nil {
+		helper.err = ErrPostNotFound
+		return nil
+	}
+
+	post := helper.getPost(postId)
+	if helper.err == nil && post.UserId == "" {
+		helper.err = ErrPostNotFound
+	}
+	if helper.err != nil {
+		return nil
+	}
+	return post
+}
+
+// deletePost deletes the post, and the reposts of it with it.
+func (helper *DBHelper) deletePost(post *Post) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	if post.RepostOf != "" {
+		helper.forgetRepost(post)
+		if helper.err != nil {
+			return
+		}
+	}
+
+	helper.forgetLikes(post.Id)
+	if helper.err != nil {
+		return
+	}
+	helper.forgetReactions(post.Id)
+	if helper.err != nil {
+		return
+	}
+
+	var reposts map[string]string
+	reposts, helper.err = redis.StringMap(redisConn.Do("HGETALL", "reposts:"+post.Id))
+	if helper.err != nil {
+		return
+	}
+
+	redisConn.Send("MULTI")
+	redisConn.Send("DEL", "post:"+post.Id, "post_history:"+post.Id, "replies:"+post.Id,
+		"reposts:"+post.Id, "delivered:"+post.Id)
+	for userId, repostId := range reposts {
+		redisConn.Send("DEL", "post:"+repostId)
+		redisConn.Send("LREM", "user_posts:"+userId, 0, repostId)
+		redisConn.Send("SADD", "deleted_posts", repostId)
+	}
+	if post.InReplyTo != "" {
+		redisConn.Send("ZREM", "replies:"+post.InReplyTo, post.Id)
+	}
+	for _, userId := range post.Mentions {
+		redisConn.Send("LREM", "mentions:"+userId, 0, post.Id)
+	}
+	retag(redisConn, post, post.Tags, nil)
+	redisConn.Send("LREM", "user_posts:"+post.UserId, 0, post.Id)
+	redisConn.Send("LREM", "timeline", 0, post.Id)
+	redisConn.Send("SADD", "deleted_posts", post.Id)
+	_, helper.err = redisConn.Do("EXEC")
+}
+
+func (helper *DBHelper) editPost(post *Post, body string) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	written := post.Posted
+	if post.Edited > 0 {
+		written = post.Edited
+	}
+	version, _ := json.Marshal(&PostVersion{post.Body, written})
+
+	mentions := helper.findMentions(body)
+	if helper.err != nil {
+		return
+	}
+	before := parseMentions(post.MentionData)
+	added := []string{}
+	for key, userId := range mentions {
+		if before[key] != userId {
+			added = append(added, userId)
+		}
+	}
+
+	// A delete meanwhile must not bring back part of the post, and an edit
+	// meanwhile must not be lost from the history.
+	_, helper.err = redisConn.Do("WATCH", "post:"+post.Id)
+	if helper.err != nil {
+		return
+	}
+	helper.checkUnchanged(redisConn, post)
+	if helper.err != nil {
+		redisConn.Do("UNWATCH")
+		return
+	}
+
+	redisConn.Send("MULTI")
+	redisConn.Send("LPUSH", "post_history:"+post.Id, version)
+	tags := findTags(body)
+	redisConn.Send("HMSET", "post:"+post.Id, "body", body, "edited", time.Now().Unix(),
+		"mentions", encodeMentions(mentions), "tags", strings.Join(tags, " "))
+	retag(redisConn, post, post.Tags, tags)
+	for key, userId := range before {
+		if mentions[key] != userId {
+			redisConn.Send("LREM", "mentions:"+userId, 0, post.Id)
+		}
+	}
+	var reply interface{}
+	reply, helper.err = redisConn.Do("EXEC")
+	if helper.err == nil && reply == nil {
+		helper.checkUnchanged(redisConn, post)
+		if helper.err == nil {
+			helper.err = ErrEditConflict
+		}
+	}
+	if helper.err == nil {
+		helper.deliverMentions(post, added)
+	}
+}
+
+// checkUnchanged fails with ErrPostNotFound when the post was deleted since
+// it was loaded and with ErrEditConflict when it was edited.
+func (helper *DBHelper) checkUnchanged(redisConn redis.Conn, post *Post) {
+	var values []interface{}
+	values, helper.err = redis.Values(redisConn.Do("HMGET", "post:"+post.Id, "userId", "edited"))
+	if helper.err != nil {
+		return
+	}
+	var (
+		userId string
+		edited int64
+	)
+	_, helper.err = redis.Scan(values, &userId, &edited)
+	if helper.err == nil && userId == "" {
+		helper.err = ErrPostNotFound
+	}
+	if helper.err == nil && edited != post.Edited {
+		helper.err = ErrEditConflict
+	}
+}
+
+// getPostVersions returns every version of the post, the current one first.
+func (helper *DBHelper) getPostVersions(post *Post) []*PostVersion {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	written := post.Posted
+	if post.Edited > 0 {
+		written = post.Edited
+	}
+	versions := []*PostVersion{{post.Body, written}}
+
+	var values []string
+	values, helper.err = redis.Strings(redisConn.Do("LRANGE", "post_history:"+post.Id, 0, -1))
+	for _, value := range values {
+		version := &PostVersion{}
+		if err := json.Unmarshal([]byte(value), version); err == nil {
+			versions = append(versions, version)
+		}
+	}
+	return versions
+}
+
+// sweepDeletedPosts removes the deleted posts from the posts:* lists. The
+// ids are moved to post_sweep first, posts deleted meanwhile wait for the
+// next sweep. It reports whether there was anything to do.
+func (helper *DBHelper) sweepDeletedPosts() bool {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	token := helper.lock(redisConn, "post_sweep_lock", postSweepLockTTL)
+	if token == "" {
+		return false
+	}
+	defer unlock(redisConn, "post_sweep_lock", token)
+
+	var sweeping bool
+	sweeping, helper.err = redis.Bool(redisConn.Do("EXISTS", "post_sweep"))
+	if helper.err != nil {
+		return false
+	}
+	if !sweeping {
+		var deleted bool
+		deleted, helper.err = redis.Bool(redisConn.Do("EXISTS", "deleted_posts"))
+		if helper.err != nil || !deleted {
+			return false
+		}
+		_, helper.err = redisConn.Do("RENAME", "deleted_posts", "post_sweep")
+		if helper.err != nil {
+			return false
+		}
+	}
+
+	var cursor string
+	cursor, helper.err = redis.String(redisConn.Do("GET", "post_sweep_cursor"))
+	if helper.err == redis.ErrNil {
+		cursor, helper.err = "0", nil
+	}
+
+	for helper.err == nil {
+		var values []interface{}
+		values, helper.err = redis.Values(redisConn.Do("SCAN", cursor, "MATCH", "posts:*", "COUNT", deletionBatch))
+		if helper.err != nil {
+			return true
+		}
+
+		var keys []string
+		cursor, _ = redis.String(values[0], nil)
+		keys, helper.err = redis.Strings(values[1], nil)
+		for _, key := range keys {
+			if helper.err == nil {
+				_, helper.err = filterListScript.Do(redisConn, key, "post_sweep")
+			}
+		}
+		if helper.err != nil {
+			return true
+		}
+
+		if cursor == "0" {
+			_, helper.err = redisConn.Do("DEL", "post_sweep", "post_sweep_cursor")
+			return true
+		}
+		redisConn.Send("MULTI")
+		redisConn.Send("SET", "post_sweep_cursor", cursor)
+		renewLockScript.Send(redisConn, "post_sweep_lock", token, postSweepLockTTL)
+		_, helper.err = redisConn.Do("EXEC")
+	}
+	return true
+}
+
+// runPostSweeps is the background worker, it runs until the server stops.
+func runPostSweeps() {
+	for {
+		helper := DBHelper{}
+		helper.sweepDeletedPosts()
+		if helper.err != nil {
+			log.Printf("err in post sweep %v", helper.err)
+		}
+		time.Sleep(postSweepInterval)
+	}
+}
+
+// Post Handlers
+
+func editPostHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	post := helper.postParam(r)
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+	if post.UserId != user.UserId {
+		Goback(w, r, ErrNotAuthor)
+		return
+	}
+
+	// Past the window the page only offers to delete the post.
+	templateParams := map[string]interface{}{}
+	templateParams["user"] = user
+	templateParams["post"] = post
+	templateParams["canEdit"] = post.CanEdit()
+	templateParams["csrf"] = csrfToken(user.UserId, "post")
+
+	tmplRender.HTML(w, http.StatusOK, "post_edit", templateParams)
+}
+
+func savePostHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	if !checkCSRF(r, user.UserId, "post") {
+		Goback(w, r, errors.New("Your session has expired, please reload the page."))
+		return
+	}
+
+	post := helper.postParam(r)
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+	if post.UserId != user.UserId {
+		Goback(w, r, ErrNotAuthor)
+		return
+	}
+	if post.RepostOf != "" {
+		Goback(w, r, ErrRepostEdit)
+		return
+	}
+	if !post.CanEdit() {
+		Goback(w, r, ErrEditWindow)
+		return
+	}
+
+	body := strings.Replace(r.PostFormValue("status"), "\n", " ", -1)
+	if strings.TrimSpace(body) == "" && len(post.Attachments) == 0 {
+		Goback(w, r, ErrEmptyBody)
+		return
+	}
+
+	if body != post.Body {
+		helper.editPost(post, body)
+		if helper.err != nil {
+			Goback(w, r, helper.err)
+			return
+		}
+	}
+
+	http.Redirect(w, r, "/home", http.StatusFound)
+}
+
+func deletePostHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	if !checkCSRF(r, user.UserId, "post") {
+		Goback(w, r, errors.New("Your session has expired, please reload the page."))
+		return
+	}
+
+	post := helper.postParam(r)
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+	if post.UserId != user.UserId {
+		Goback(w, r, ErrNotAuthor)
+		return
+	}
+
+	helper.deletePost(post)
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+
+	http.Redirect(w, r, "/home", http.StatusFound)
+}
+
+func postHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+
+	post := helper.postParam(r)
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+
+	versions := helper.getPostVersions(post)
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+
+	templateParams := map[string]interface{}{}
+	templateParams["user"] = context.Get(r, "user")
+	templateParams["post"] = post
+	templateParams["versions"] = versions
+
+	tmplRender.HTML(w, http.StatusOK, "post_history", templateParams)
+}
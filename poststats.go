@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/context"
+)
+
+// The lists load the counts under their posts, what the user looking at them
+// did with them and the names they link to in two pipelines, a page of posts
+// costs two round trips instead of a dozen per post. The template methods
+// fall back to asking Redis for posts loaded on their own.
+
+type PostStats struct {
+	Replies   int         `json:"replies"`
+	Reposts   int         `json:"reposts"`
+	Likes     int         `json:"likes"`
+	Liked     bool        `json:"liked"`
+	Reposted  bool        `json:"reposted"`
+	Reactions []*Reaction `json:"reactions"`
+
+	viewerId    string
+	replyToName string
+}
+
+// loadPostStats fills in the Stats of the posts for the user, who may be
+// empty, and the names of the users they mention.
+func (helper *DBHelper) loadPostStats(posts []*Post, viewerId string) {
+	if helper.err != nil || len(posts) == 0 {
+		return
+	}
+
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	emojis := reactionSet()
+	for _, post := range posts {
+		redisConn.Send("ZCARD", "replies:"+post.Id)
+		redisConn.Send("HLEN", "reposts:"+post.Id)
+		redisConn.Send("ZCARD", "likes:"+post.Id)
+		redisConn.Send("ZSCORE", "likes:"+post.Id, viewerId)
+		redisConn.Send("HEXISTS", "reposts:"+post.Id, viewerId)
+		redisConn.Send("HGET", "post:"+post.InReplyTo, "userId")
+		for _, emoji := range emojis {
+			redisConn.Send("ZCARD", "reactions:"+post.Id+":"+emoji)
+			redisConn.Send("ZSCORE", "reactions:"+post.Id+":"+emoji, viewerId)
+		}
+	}
+	helper.err = redisConn.Flush()
+	if helper.err != nil {
+		return
+	}
+
+	parentAuthors := make([]string, len(posts))
+	for i, post := range posts {
+		stats := &PostStats{viewerId: viewerId, Reactions: []*Reaction{}}
+		stats.Replies, _ = redis.Int(redisConn.Receive())
+		stats.Reposts, _ = redis.Int(redisConn.Receive())
+		stats.Likes, _ = redis.Int(redisConn.Receive())
+		liked, _ := redisConn.Receive()
+		stats.Liked = viewerId != "" && liked != nil
+		stats.Reposted, _ = redis.Bool(redisConn.Receive())
+		parentAuthors[i], _ = redis.String(redisConn.Receive())
+		for _, emoji := range emojis {
+			count, _ := redis.Int(redisConn.Receive())
+			reacted, err := redisConn.Receive()
+			if err != nil {
+				helper.err = err
+				return
+			}
+			stats.Reactions = append(stats.Reactions, &Reaction{Emoji: emoji, Count: count, Reacted: viewerId != "" && reacted != nil})
+		}
+		post.Stats = stats
+	}
+
+	// The names come second, they need the authors of the posts replied to.
+	type nameRequest struct {
+		post   *Post
+		userId string
+		parent bool
+	}
+	requests := []*nameRequest{}
+	for i, post := range posts {
+		if parentAuthors[i] != "" {
+			requests = append(requests, &nameRequest{post, parentAuthors[i], true})
+		}
+		for _, p := range []*Post{post, post.Quoted} {
+			if p == nil {
+				continue
+			}
+			p.mentionNames = map[string]string{}
+			for _, userId := range p.Mentions {
+				requests = append(requests, &nameRequest{p, userId, false})
+			}
+		}
+	}
+	for _, request := range requests {
+		redisConn.Send("HGET", "user:"+request.userId, "userName")
+	}
+	helper.err = redisConn.Flush()
+	if helper.err != nil {
+		return
+	}
+	for _, request := range requests {
+		userName, _ := redis.String(redisConn.Receive())
+		if request.parent {
+			request.post.Stats.replyToName = userName
+		} else if userName != "" {
+			request.post.mentionNames[request.userId] = userName
+		}
+	}
+}
+
+// viewerId returns the id of the signed in user, empty for visitors.
+func viewerId(r *http.Request) string {
+	if user, ok := context.Get(r, "user").(*User); ok && user != nil {
+		return user.UserId
+	}
+	return ""
+}
+
+// viewedBy reports whether the stats of the post were loaded for the user.
+func (p *Post) viewedBy(userId string) bool {
+	return p.Stats != nil && p.Stats.viewerId == userId
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/context"
+)
+
+// The profile fields are stored on user:<id> next to the account. The join
+// date is the score of the user in users_by_time.
+
+const (
+	displayNameMaxLength = 50
+	bioMaxLength         = 160
+	locationMaxLength    = 30
+	websiteMaxLength     = 100
+)
+
+var ErrWebsite = errors.New("The website must be a http:// or https:// address.")
+
+// Name is the display name, or the username for users who didn't set one.
+func (u *User) Name() string {
+	if u.DisplayName != "" {
+		return u.DisplayName
+	}
+	return u.UserName
+}
+
+func (u *User) JoinedTime() time.Time {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var joined int64
+	joined, u.err = redis.Int64(redisConn.Do("ZSCORE", "users_by_time", u.UserName))
+	if u.err != nil {
+		return time.Time{}
+	}
+	return time.Unix(joined, 0)
+}
+
+func (u *User) Joined() string {
+	joined := u.JoinedTime()
+	if joined.IsZero() {
+		return ""
+	}
+	return joined.UTC().Format("January 2006")
+}
+
+func (u *User) GetPostCount() int {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var count int
+	count, u.err = redis.Int(redisConn.Do("LLEN", "user_posts:"+u.UserId))
+	return count
+}
+
+// profileText trims the value, joins its lines and checks the length.
+func profileText(value string, field string, maxLength int) (string, error) {
+	value = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, value))
+
+	if utf8.RuneCountInString(value) > maxLength {
+		return "", fmt.Errorf("The %s can't be longer than %d characters.", field, maxLength)
+	}
+	return value, nil
+}
+
+func parseWebsite(website string) (string, error) {
+	website = strings.TrimSpace(website)
+	if website == "" {
+		return "", nil
+	}
+	if len(website) > websiteMaxLength {
+		return "", fmt.Errorf("The website can't be longer than %d characters.", websiteMaxLength)
+	}
+
+	if !strings.Contains(website, "://") {
+		website = "https://" + website
+	}
+	u, err := url.Parse(website)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", ErrWebsite
+	}
+	return u.String(), nil
+}
+
+func (helper *DBHelper) setProfile(user *User) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	_, helper.err = redisConn.Do("HMSET", "user:"+user.UserId,
+		"displayName", user.DisplayName,
+		"bio", user.Bio,
+		"location", user.Location,
+		"website", user.Website)
+}
+
+// Profile Handlers
+
+func editProfileHandler(w http.ResponseWriter, r *http.Request) {
+	user := context.Get(r, "user").(*User)
+
+	templateParams := map[string]interface{}{}
+	templateParams["user"] = user
+	templateParams["csrf"] = csrfToken(user.UserId, "profile")
+	templateParams["maxImageSize"] = fmt.Sprintf("%d MB", *maxImageBytes>>20)
+
+	tmplRender.HTML(w, http.StatusOK, "profile_edit", templateParams)
+}
+
+func saveProfileHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	if !checkCSRF(r, user.UserId, "profile") {
+		Goback(w, r, errors.New("Your session has expired, please reload the page."))
+		return
+	}
+
+	profile := *user
+	var err error
+	for _, field := range []struct {
+		value     *string
+		form      string
+		name      string
+		maxLength int
+	}{
+		{&profile.DisplayName, "displayName", "display name", displayNameMaxLength},
+		{&profile.Bio, "bio", "bio", bioMaxLength},
+		{&profile.Location, "location", "location", locationMaxLength},
+	} {
+		*field.value, err = profileText(r.PostFormValue(field.form), field.name, field.maxLength)
+		if err != nil {
+			Goback(w, r, err)
+			return
+		}
+	}
+
+	profile.Website, err = parseWebsite(r.PostFormValue("website"))
+	if err != nil {
+		Goback(w, r, err)
+		return
+	}
+
+	helper.setProfile(&profile)
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+
+	http.Redirect(w, r, "/Profile?u="+url.QueryEscape(user.UserName), http.StatusFound)
+}
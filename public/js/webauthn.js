@@ -0,0 +1,100 @@
+// Browser side of the passkey ceremonies, see webauthn.go.
+
+function b64encode(buffer) {
+	var bytes = new Uint8Array(buffer), s = "";
+	for (var i = 0; i < bytes.length; i++) {
+		s += String.fromCharCode(bytes[i]);
+	}
+	return btoa(s).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+}
+
+function b64decode(s) {
+	s = s.replace(/-/g, "+").replace(/_/g, "/");
+	while (s.length % 4) {
+		s += "=";
+	}
+	var raw = atob(s), bytes = new Uint8Array(raw.length);
+	for (var i = 0; i < raw.length; i++) {
+		bytes[i] = raw.charCodeAt(i);
+	}
+	return bytes.buffer;
+}
+
+function postJSON(url, body) {
+	return fetch(url, {
+		method: "POST",
+		credentials: "same-origin",
+		headers: {"Content-Type": "application/json"},
+		body: JSON.stringify(body || {})
+	}).then(function (resp) {
+		return resp.json().then(function (json) {
+			if (!resp.ok) {
+				throw new Error(json.errors ? json.errors[0].detail : resp.statusText);
+			}
+			return json.content;
+		});
+	});
+}
+
+function decodeCredentials(list) {
+	return (list || []).map(function (c) {
+		return {type: c.type, id: b64decode(c.id)};
+	});
+}
+
+function passkeyFailed(err) {
+	if (err.name !== "NotAllowedError") {
+		alert(err.message);
+	}
+}
+
+function registerPasskey(name) {
+	if (!window.PublicKeyCredential) {
+		alert("Your browser doesn't support passkeys.");
+		return;
+	}
+	postJSON("/webauthn/register/begin").then(function (options) {
+		options.challenge = b64decode(options.challenge);
+		options.user.id = b64decode(options.user.id);
+		options.excludeCredentials = decodeCredentials(options.excludeCredentials);
+		return navigator.credentials.create({publicKey: options});
+	}).then(function (cred) {
+		return postJSON("/webauthn/register/finish", {
+			id: cred.id,
+			clientDataJSON: b64encode(cred.response.clientDataJSON),
+			attestationObject: b64encode(cred.response.attestationObject),
+			name: name
+		});
+	}).then(function (result) {
+		window.location = result.redirect;
+	}).catch(passkeyFailed);
+}
+
+// signInWithPasskey runs a passwordless login when prefix is "/webauthn/login"
+// and confirms a password login when it is "/webauthn/2fa".
+function signInWithPasskey(prefix, next) {
+	if (!window.PublicKeyCredential) {
+		alert("Your browser doesn't support passkeys.");
+		return;
+	}
+	var query = next ? "?next=" + encodeURIComponent(next) : "";
+	var remember = document.querySelector("input[name=remember]");
+	if (remember && remember.checked) {
+		query += (query ? "&" : "?") + "remember=1";
+	}
+	postJSON(prefix + "/begin").then(function (options) {
+		options.challenge = b64decode(options.challenge);
+		options.allowCredentials = decodeCredentials(options.allowCredentials);
+		return navigator.credentials.get({publicKey: options});
+	}).then(function (cred) {
+		return postJSON(prefix + "/finish" + query, {
+			id: cred.id,
+			clientDataJSON: b64encode(cred.response.clientDataJSON),
+			authenticatorData: b64encode(cred.response.authenticatorData),
+			signature: b64encode(cred.response.signature),
+			userHandle: cred.response.userHandle ? b64encode(cred.response.userHandle) : ""
+		});
+	}).then(function (result) {
+		window.location = result.redirect;
+	}).catch(passkeyFailed);
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+)
+
+// A quote post has the id of the post it comments on in quoteOf and shows
+// that post as a card below its own body. Only one level is loaded, a quote
+// of a quote shows the inner quote as a link.
+//
+// The card is left out when the quoted post was deleted. There are no blocks
+// or private accounts yet, once there are loadQuote has to hide the posts the
+// viewer may not see as well.
+
+// loadQuote returns the quoted post, nil when it is gone.
+func (helper *DBHelper) loadQuote(postId string) *Post {
+	quoted := helper.loadPost(postId)
+	if helper.err != nil || quoted.UserId == "" {
+		return nil
+	}
+	return quoted
+}
+
+// quoteParam returns the post to quote named in the quote parameter, nil
+// without one.
+func (helper *DBHelper) quoteParam(r *http.Request) *Post {
+	postId := r.FormValue("quote")
+	if postId == "" {
+		return nil
+	}
+
+	quoted := helper.resolvePost(postId)
+	if helper.err == nil && quoted.UserId == "" {
+		helper.err = ErrPostNotFound
+	}
+	if helper.err != nil {
+		return nil
+	}
+	return quoted
+}
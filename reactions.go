@@ -0,0 +1,345 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/context"
+)
+
+// reactions:<postId>:<emoji> has the users who reacted to the post with the
+// emoji, scored by time, and reactions:<postId> the emojis the post got.
+// reacted:<userId> has "<postId> <emoji>" for every reaction of the user so
+// they can be taken back with the account. Like likes the count is the size
+// of the set, a reaction is either there or not.
+
+var (
+	reactionList = flag.String("reactions", "👍,❤️,😂,😮,😢,🎉", "comma separated emojis posts can be reacted to with")
+
+	ErrReaction = errors.New("This reaction isn't available.")
+
+	// reactScript adds the reaction or takes it back, toggle does whichever
+	// applies. It returns whether the reaction was added.
+	reactScript = redis.NewScript(3, `
+local reacted = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if reacted and ARGV[5] ~= 'add' then
+	redis.call('ZREM', KEYS[1], ARGV[1])
+	redis.call('ZREM', KEYS[2], ARGV[2])
+elseif not reacted and ARGV[5] ~= 'remove' then
+	redis.call('ZADD', KEYS[1], ARGV[3], ARGV[1])
+	redis.call('ZADD', KEYS[2], ARGV[3], ARGV[2])
+	redis.call('SADD', KEYS[3], ARGV[4])
+	return 1
+end
+return 0
+`)
+)
+
+const maxReactionUsers = 100
+
+type Reaction struct {
+	Emoji   string   `json:"emoji"`
+	Count   int      `json:"count"`
+	Reacted bool     `json:"reacted"`
+	Users   []string `json:"users,omitempty"`
+}
+
+type ReactionRequest struct {
+	Emoji string `json:"emoji"`
+}
+
+type ExportReaction struct {
+	PostId string `json:"postId"`
+	Emoji  string `json:"emoji"`
+	Time   string `json:"time"`
+}
+
+// reactionSet returns the configured emojis in order.
+func reactionSet() []string {
+	emojis := []string{}
+	for _, emoji := range strings.Split(*reactionList, ",") {
+		if emoji = strings.TrimSpace(emoji); emoji != "" {
+			emojis = append(emojis, emoji)
+		}
+	}
+	return emojis
+}
+
+func validReaction(emoji string) bool {
+	for _, e := range reactionSet() {
+		if e == emoji {
+			return true
+		}
+	}
+	return false
+}
+
+// Reactions returns the counts of the post for the list under it, every
+// configured emoji in order.
+func (p *Post) Reactions(userId string) []*Reaction {
+	if p.viewedBy(userId) {
+		return p.Stats.Reactions
+	}
+
+	helper := DBHelper{}
+	return helper.getReactions(p.Id, userId, false)
+}
+
+// getReactions counts the reactions to the post, with the names of the first
+// users for every emoji when withUsers is set.
+func (helper *DBHelper) getReactions(postId string, userId string, withUsers bool) []*Reaction {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	emojis := reactionSet()
+	for _, emoji := range emojis {
+		redisConn.Send("ZCARD", "reactions:"+postId+":"+emoji)
+		redisConn.Send("ZSCORE", "reactions:"+postId+":"+emoji, userId)
+	}
+	redisConn.Flush()
+
+	reactions := []*Reaction{}
+	for _, emoji := range emojis {
+		count, err := redis.Int(redisConn.Receive())
+		if err != nil {
+			helper.err = err
+			return nil
+		}
+		score, _ := redisConn.Receive()
+		reactions = append(reactions, &Reaction{Emoji: emoji, Count: count, Reacted: userId != "" && score != nil})
+	}
+	if !withUsers {
+		return reactions
+	}
+
+	for _, reaction := range reactions {
+		if reaction.Count == 0 {
+			continue
+		}
+		var userIds []string
+		userIds, helper.err = redis.Strings(redisConn.Do("ZRANGE", "reactions:"+postId+":"+reaction.Emoji, 0, maxReactionUsers-1))
+		if helper.err != nil {
+			return nil
+		}
+		for _, id := range userIds {
+			if userName, err := redis.String(redisConn.Do("HGET", "user:"+id, "userName")); err == nil {
+				reaction.Users = append(reaction.Users, userName)
+			}
+		}
+	}
+	return reactions
+}
+
+// react reacts to the post with the emoji for "add", takes the reaction back
+// for "remove" and does whichever applies for "toggle". It reports whether the
+// reaction was added.
+func (helper *DBHelper) react(user *User, post *Post, emoji string, mode string) bool {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var added bool
+	added, helper.err = redis.Bool(reactScript.Do(redisConn,
+		"reactions:"+post.Id+":"+emoji, "reacted:"+user.UserId, "reactions:"+post.Id,
+		user.UserId, post.Id+" "+emoji, time.Now().Unix(), emoji, mode))
+	if helper.err != nil || !added {
+		return false
+	}
+
+	if post.UserId != user.UserId {
+		helper.notify(post.UserId, &Notification{
+			Kind: "reaction",
+			Text: user.UserName + " reacted " + emoji + " to your post",
+			Link: "/post/" + post.Id,
+		})
+	}
+	return true
+}
+
+// forgetReactions removes the reactions to the post from the users.
+func (helper *DBHelper) forgetReactions(postId string) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var emojis []string
+	emojis, helper.err = redis.Strings(redisConn.Do("SMEMBERS", "reactions:"+postId))
+	if helper.err != nil {
+		return
+	}
+
+	keys := []interface{}{"reactions:" + postId}
+	reacted := map[string][]string{}
+	for _, emoji := range emojis {
+		var userIds []string
+		userIds, helper.err = redis.Strings(redisConn.Do("ZRANGE", "reactions:"+postId+":"+emoji, 0, -1))
+		if helper.err != nil {
+			return
+		}
+		for _, userId := range userIds {
+			reacted[userId] = append(reacted[userId], postId+" "+emoji)
+		}
+		keys = append(keys, "reactions:"+postId+":"+emoji)
+	}
+
+	redisConn.Send("MULTI")
+	for userId, members := range reacted {
+		for _, member := range members {
+			redisConn.Send("ZREM", "reacted:"+userId, member)
+		}
+	}
+	redisConn.Send("DEL", keys...)
+	_, helper.err = redisConn.Do("EXEC")
+}
+
+// purgeReactions takes back the reactions of the user, a batch per call.
+func (helper *DBHelper) purgeReactions(userId string, cursor string) (string, bool) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	if cursor == "" {
+		cursor = "0"
+	}
+
+	var values []interface{}
+	values, helper.err = redis.Values(redisConn.Do("ZSCAN", "reacted:"+userId, cursor, "COUNT", deletionBatch))
+	if helper.err != nil {
+		return cursor, false
+	}
+
+	// The members come with their scores.
+	var members []string
+	cursor, _ = redis.String(values[0], nil)
+	members, helper.err = redis.Strings(values[1], nil)
+	if helper.err != nil {
+		return cursor, false
+	}
+
+	redisConn.Send("MULTI")
+	for i := 0; i < len(members); i += 2 {
+		if j := strings.Index(members[i], " "); j > 0 {
+			redisConn.Send("ZREM", "reactions:"+members[i][:j]+":"+members[i][j+1:], userId)
+		}
+	}
+	if cursor == "0" {
+		redisConn.Send("DEL", "reacted:"+userId)
+	}
+	_, helper.err = redisConn.Do("EXEC")
+	return cursor, helper.err == nil && cursor == "0"
+}
+
+func (helper *DBHelper) exportReactions(user *User) interface{} {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var values []string
+	values, helper.err = redis.Strings(redisConn.Do("ZRANGE", "reacted:"+user.UserId, 0, -1, "WITHSCORES"))
+
+	reactions := []*ExportReaction{}
+	for i := 0; i+1 < len(values); i += 2 {
+		t, _ := strconv.ParseInt(values[i+1], 10, 64)
+		if j := strings.Index(values[i], " "); j > 0 {
+			reactions = append(reactions, &ExportReaction{values[i][:j], values[i][j+1:], exportTime(t)})
+		}
+	}
+	return reactions
+}
+
+// Reaction Handlers
+
+func reactHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	if !checkCSRF(r, user.UserId, "post") {
+		Goback(w, r, errors.New("Your session has expired, please reload the page."))
+		return
+	}
+
+	emoji := r.PostFormValue("emoji")
+	if !validReaction(emoji) {
+		Goback(w, r, ErrReaction)
+		return
+	}
+
+	post := helper.likedPostParam(r)
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+
+	helper.react(user, post, emoji, "toggle")
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+
+	redirectBack(w, r)
+}
+
+func apiReactionsHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	post := helper.likedPostParam(r)
+	if helper.err == ErrPostNotFound {
+		WriteError(w, ErrNotFound)
+		return
+	}
+	if helper.err != nil {
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	reactions := helper.getReactions(post.Id, user.UserId, true)
+	if helper.err != nil {
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	tmplRender.JSON(w, http.StatusOK, Response{"ok", reactions})
+}
+
+// apiReactHandler adds the reaction in the body, or takes it back with undo.
+// Unlike the toggle of the web page both are idempotent.
+func apiReactHandler(undo bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		helper := DBHelper{}
+		user := context.Get(r, "user").(*User)
+		body := context.Get(r, "body").(*ReactionRequest)
+
+		if !validReaction(body.Emoji) {
+			WriteError(w, &Error{"invalid_reaction", 422, "Unprocessable Entity", ErrReaction.Error()})
+			return
+		}
+
+		post := helper.likedPostParam(r)
+		if helper.err == ErrPostNotFound {
+			WriteError(w, ErrNotFound)
+			return
+		}
+		if helper.err != nil {
+			WriteError(w, ErrInternalServer)
+			return
+		}
+
+		if undo {
+			helper.react(user, post, body.Emoji, "remove")
+		} else {
+			helper.react(user, post, body.Emoji, "add")
+		}
+		var reactions []*Reaction
+		if helper.err == nil {
+			reactions = helper.getReactions(post.Id, user.UserId, true)
+		}
+		if helper.err != nil {
+			WriteError(w, ErrInternalServer)
+			return
+		}
+
+		tmplRender.JSON(w, http.StatusOK, Response{"ok", reactions})
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/context"
+)
+
+const verifyTokenTTL = 24 * 60 * 60
+
+var (
+	registrationMode = flag.String("registrationMode", "open", "open, verified (accounts must verify their email before posting), invite or closed")
+	verifyEmail      = flag.Bool("verifyEmail", false, "require a verified email address before posting in every registration mode")
+	invitesPerUser   = flag.Int("invitesPerUser", 5, "number of unused invite codes a user can hold, admins have no limit")
+
+	ErrRegistrationClosed = errors.New("Sorry, registration is closed.")
+	ErrInvalidInvite      = errors.New("The invite code is invalid or has already been used.")
+	ErrUnverifiedEmail    = errors.New("Please verify your email address before posting.")
+	ErrTooManyInvites     = errors.New("You can't create more invites until some of yours have been used.")
+)
+
+func requireVerifiedEmail() bool {
+	return *verifyEmail || *registrationMode == "verified"
+}
+
+func (u *User) CanPost() bool {
+	return u.EmailVerified || !requireVerifiedEmail()
+}
+
+func (u *User) IsAdmin() bool {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var admin bool
+	admin, u.err = redis.Bool(redisConn.Do("SISMEMBER", "admins", u.UserId))
+	return admin
+}
+
+// admitRegistration checks the registration mode and consumes the invite code
+// of the request when one is needed. It returns the id of the inviter.
+func (helper *DBHelper) admitRegistration(r *http.Request) string {
+	switch *registrationMode {
+	case "closed":
+		helper.err = ErrRegistrationClosed
+	case "invite":
+		inviterId := helper.takeInvite(strings.TrimSpace(r.PostFormValue("invite")))
+		if helper.err != nil {
+			helper.err = ErrInvalidInvite
+		}
+		return inviterId
+	default:
+		helper.err = nil
+	}
+	return ""
+}
+
+func (helper *DBHelper) createInvite(user *User) string {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	if !user.IsAdmin() {
+		var count int
+		count, helper.err = redis.Int(redisConn.Do("SCARD", "invites:"+user.UserId))
+		if helper.err != nil {
+			return ""
+		}
+		if count >= *invitesPerUser {
+			helper.err = ErrTooManyInvites
+			return ""
+		}
+	}
+
+	code := randomToken(9)
+	redisConn.Send("MULTI")
+	redisConn.Send("SET", "invite:"+code, user.UserId)
+	redisConn.Send("SADD", "invites:"+user.UserId, code)
+	_, helper.err = redisConn.Do("EXEC")
+	return code
+}
+
+func (helper *DBHelper) getInvites(userId string) []string {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var codes []string
+	codes, helper.err = redis.Strings(redisConn.Do("SMEMBERS", "invites:"+userId))
+	sort.Strings(codes)
+	return codes
+}
+
+func (helper *DBHelper) takeInvite(code string) string {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var (
+		inviterId string
+		values    []interface{}
+	)
+	redisConn.Send("MULTI")
+	redisConn.Send("GET", "invite:"+code)
+	redisConn.Send("DEL", "invite:"+code)
+	values, helper.err = redis.Values(redisConn.Do("EXEC"))
+	if helper.err != nil {
+		return ""
+	}
+	inviterId, helper.err = redis.String(values[0], nil)
+	if helper.err != nil {
+		return ""
+	}
+	_, helper.err = redisConn.Do("SREM", "invites:"+inviterId, code)
+	return inviterId
+}
+
+// restoreInvite gives back an invite which was taken for a registration that
+// failed afterwards.
+func (helper *DBHelper) restoreInvite(inviterId string, code string) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	redisConn.Send("MULTI")
+	redisConn.Send("SET", "invite:"+code, inviterId)
+	redisConn.Send("SADD", "invites:"+inviterId, code)
+	_, helper.err = redisConn.Do("EXEC")
+}
+
+// recordInvite keeps the invite tree so admins can see who invited whom.
+func (helper *DBHelper) recordInvite(inviterId string, userId string) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	redisConn.Send("MULTI")
+	redisConn.Send("HSET", "invited_by", userId, inviterId)
+	redisConn.Send("SADD", "invitees:"+inviterId, userId)
+	_, helper.err = redisConn.Do("EXEC")
+}
+
+type InviteNode struct {
+	User     *User
+	Children []*InviteNode
+}
+
+func (helper *DBHelper) getInviteTree() []*InviteNode {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var invitedBy map[string]string
+	invitedBy, helper.err = redis.StringMap(redisConn.Do("HGETALL", "invited_by"))
+	if helper.err != nil {
+		return nil
+	}
+
+	nodes := map[string]*InviteNode{}
+	node := func(userId string) *InviteNode {
+		if nodes[userId] == nil {
+			user := helper.loadUserInfo(userId)
+			if user == nil {
+				user = &User{UserId: userId, UserName: "(deleted user " + userId + ")"}
+			}
+			nodes[userId] = &InviteNode{User: user}
+		}
+		return nodes[userId]
+	}
+
+	ids := []string{}
+	for userId := range invitedBy {
+		ids = append(ids, userId)
+	}
+	sort.Strings(ids)
+
+	for _, userId := range ids {
+		parent := node(invitedBy[userId])
+		parent.Children = append(parent.Children, node(userId))
+	}
+
+	roots := []*InviteNode{}
+	for userId, n := range nodes {
+		if _, ok := invitedBy[userId]; !ok {
+			roots = append(roots, n)
+		}
+	}
+	sort.Slice(roots, func(i, j int) bool { return roots[i].User.UserName < roots[j].User.UserName })
+	helper.err = nil
+	return roots
+}
+
+func (helper *DBHelper) sendVerification(user *User) {
+	if user.Email == "" {
+		return
+	}
+
+	token := helper.createToken("verify", user.UserId+" "+user.Email, verifyTokenTTL)
+	if helper.err != nil {
+		return
+	}
+
+	helper.err = mailer.Send(&Mail{
+		To:      user.Email,
+		Subject: "Verify your SimpleGo email address",
+		Body: "Hi " + user.UserName + ",\r\n\r\n" +
+			"please confirm that this is your email address by opening the link below:\r\n\r\n" +
+			strings.TrimRight(*baseURL, "/") + "/verify?token=" + token + "\r\n",
+	})
+}
+
+// verifyEmailToken fails when the address changed after the mail was sent.
+func (helper *DBHelper) verifyEmailToken(token string) *User {
+	value := helper.takeToken("verify", token)
+	if helper.err != nil {
+		return nil
+	}
+
+	parts := strings.SplitN(value, " ", 2)
+	user := helper.loadUserInfo(parts[0])
+	if user == nil || len(parts) != 2 || user.Email != parts[1] {
+		helper.err = errors.New("The verification link is invalid or has expired.")
+		return nil
+	}
+
+	helper.markEmailVerified(user.UserId)
+	user.EmailVerified = true
+	return user
+}
+
+func (helper *DBHelper) markEmailVerified(userId string) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	_, helper.err = redisConn.Do("HSET", "user:"+userId, "emailVerified", true)
+}
+
+// Registration Handlers
+
+func verifyHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+
+	helper.verifyEmailToken(r.FormValue("token"))
+	if helper.err == redis.ErrNil {
+		Goback(w, r, errors.New("The verification link is invalid or has expired."))
+		return
+	}
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+
+	http.Redirect(w, r, "/settings", http.StatusFound)
+}
+
+func resendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	if !checkCSRF(r, user.UserId, "settings") {
+		Goback(w, r, errors.New("Your session has expired, please reload the page."))
+		return
+	}
+
+	helper.sendVerification(user)
+	if helper.err != nil {
+		log.Printf("err in send verification mail %v", helper.err)
+		Goback(w, r, errors.New("The verification mail couldn't be sent, please try again later."))
+		return
+	}
+
+	templateParams := map[string]interface{}{}
+	templateParams["user"] = user
+	templateParams["message"] = "We've sent a verification link to " + user.Email + "."
+	templateParams["csrf"] = csrfToken(user.UserId, "settings")
+	tmplRender.HTML(w, http.StatusOK, "settings", templateParams)
+}
+
+func invitesHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	templateParams := map[string]interface{}{}
+	templateParams["user"] = user
+	templateParams["invites"] = helper.getInvites(user.UserId)
+	templateParams["csrf"] = csrfToken(user.UserId, "invites")
+
+	tmplRender.HTML(w, http.StatusOK, "invites", templateParams)
+}
+
+func createInviteHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	if !checkCSRF(r, user.UserId, "invites") {
+		Goback(w, r, errors.New("Your session has expired, please reload the page."))
+		return
+	}
+
+	helper.createInvite(user)
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+
+	http.Redirect(w, r, "/invites", http.StatusFound)
+}
+
+func adminInvitesHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	if !user.IsAdmin() {
+		WriteError(w, ErrNotFound)
+		return
+	}
+
+	tree := helper.getInviteTree()
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+
+	templateParams := map[string]interface{}{}
+	templateParams["user"] = user
+	templateParams["tree"] = tree
+
+	tmplRender.HTML(w, http.StatusOK, "admin_invites", templateParams)
+}
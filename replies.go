@@ -0,0 +1,212 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/context"
+)
+
+// A reply has the id of the post it answers in inReplyTo and is kept in the
+// replies:<postId> sorted set of that post, scored by time. Like elsewhere,
+// a reply only shows up on the home page of the followers of its author who
+// follow the author of the post as well, nobody wants half a conversation.
+
+const (
+	maxThreadAncestors = 50
+	maxThreadReplies   = 500
+	maxThreadIndent    = 8
+)
+
+type ThreadPost struct {
+	*Post
+	Depth int
+}
+
+func (p *ThreadPost) Indent() int {
+	if p.Depth > maxThreadIndent {
+		return maxThreadIndent * 20
+	}
+	return p.Depth * 20
+}
+
+func (p *ThreadPost) Card(user interface{}) *PostCard {
+	card := p.Post.Card(user)
+	card.Thread = true
+	card.Indent = p.Indent()
+	return card
+}
+
+func (p *Post) ReplyCount() int {
+	if p.Stats != nil {
+		return p.Stats.Replies
+	}
+
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	count, _ := redis.Int(redisConn.Do("ZCARD", "replies:"+p.Id))
+	return count
+}
+
+// ReplyToName is the name of the author of the post this one answers, empty
+// when that post was deleted.
+func (p *Post) ReplyToName() string {
+	if p.Stats != nil {
+		return p.Stats.replyToName
+	}
+
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	userId, err := redis.String(redisConn.Do("HGET", "post:"+p.InReplyTo, "userId"))
+	if err != nil {
+		return ""
+	}
+	userName, _ := redis.String(redisConn.Do("HGET", "user:"+userId, "userName"))
+	return userName
+}
+
+// replyAudience keeps the followers who follow the author of the parent too.
+func (helper *DBHelper) replyAudience(followers []string, parent *Post) []string {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var parentFollowers []string
+	parentFollowers, helper.err = redis.Strings(redisConn.Do("ZRANGE", "followers:"+parent.UserId, 0, -1))
+	following := map[string]bool{parent.UserId: true}
+	for _, followerId := range parentFollowers {
+		following[followerId] = true
+	}
+
+	audience := []string{}
+	for _, followerId := range followers {
+		if following[followerId] {
+			audience = append(audience, followerId)
+		}
+	}
+	return audience
+}
+
+// getAncestors returns the posts the post answers, the first post of the
+// conversation first. missing reports whether the chain ends in a deleted
+// post.
+func (helper *DBHelper) getAncestors(post *Post) (ancestors []*Post, missing bool) {
+	seen := map[string]bool{post.Id: true}
+	for parentId := post.InReplyTo; parentId != "" && len(ancestors) < maxThreadAncestors; {
+		if seen[parentId] {
+			break
+		}
+		seen[parentId] = true
+
+		parent := helper.getPost(parentId)
+		if helper.err != nil {
+			return nil, false
+		}
+		if parent.UserId == "" {
+			missing = true
+			break
+		}
+		parent.Time = strElapsed(parent.Time)
+		ancestors = append([]*Post{parent}, ancestors...)
+		parentId = parent.InReplyTo
+	}
+	return ancestors, missing
+}
+
+// getDescendants returns the replies to the post depth first, oldest first
+// at every level.
+func (helper *DBHelper) getDescendants(postId string) []*ThreadPost {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	descendants := []*ThreadPost{}
+	seen := map[string]bool{postId: true}
+
+	var walk func(postId string, depth int)
+	walk = func(postId string, depth int) {
+		var replyIds []string
+		replyIds, helper.err = redis.Strings(redisConn.Do("ZRANGE", "replies:"+postId, 0, -1))
+		for _, replyId := range replyIds {
+			if helper.err != nil || len(descendants) >= maxThreadReplies {
+				return
+			}
+			if seen[replyId] {
+				continue
+			}
+			seen[replyId] = true
+
+			reply := helper.getPost(replyId)
+			if reply.UserId == "" {
+				continue
+			}
+			reply.Time = strElapsed(reply.Time)
+			descendants = append(descendants, &ThreadPost{reply, depth})
+			walk(replyId, depth+1)
+		}
+	}
+	walk(postId, 0)
+	return descendants
+}
+
+// Reply Handlers
+
+func threadHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+
+	post := helper.postParam(r)
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+	if post.RepostOf != "" {
+		http.Redirect(w, r, "/post/"+post.RepostOf, http.StatusFound)
+		return
+	}
+	post.Time = strElapsed(post.Time)
+
+	ancestors, missing := helper.getAncestors(post)
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+	replies := helper.getDescendants(post.Id)
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+
+	user, _ := context.Get(r, "user").(*User)
+	reactions := helper.getReactions(post.Id, viewerId(r), true)
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+
+	// The whole conversation is counted in one go.
+	posts := append([]*Post{post}, ancestors...)
+	for _, reply := range replies {
+		posts = append(posts, reply.Post)
+	}
+	helper.loadPostStats(posts, viewerId(r))
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+
+	ancestorCards := make([]*PostCard, len(ancestors))
+	for i, ancestor := range ancestors {
+		ancestorCards[i] = ancestor.Card(user)
+		ancestorCards[i].Thread = true
+	}
+
+	templateParams := map[string]interface{}{}
+	templateParams["user"] = context.Get(r, "user")
+	templateParams["post"] = post
+	templateParams["card"] = &PostCard{Post: post, User: user, Thread: true, Focus: true, Reactors: reactions}
+	templateParams["ancestors"] = ancestorCards
+	templateParams["missingParent"] = missing
+	templateParams["replies"] = replies
+
+	tmplRender.HTML(w, http.StatusOK, "post", templateParams)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/context"
+)
+
+// A repost is a post:<id> with the id of the reposted post in repostOf and
+// no body of its own, post delivers it like any other post. The lists show
+// the reposted post in its place with RepostedBy set, so replies, edits and
+// counts always go to the original. reposts:<postId> maps the users who
+// reposted the post to their repost.
+//
+// delivered:<postId> maps everyone who got the post on their home page to
+// the repost they got it through, 0 for the post itself. post fills it with
+// the recipients when it fans the post out, which for a reply aren't all the
+// followers, and it keeps a post from showing up twice when several people
+// someone follows repost it. That is a field per recipient on top of the
+// fan-out, so the hash expires deliveredTTL after the last delivery. By then
+// the post is far down the home pages and a late repost may bring it back.
+
+// deliveredTTL is how long delivered:<postId> is kept, in seconds.
+const deliveredTTL = 30 * 24 * 60 * 60
+
+var (
+	ErrRepostOwn   = errors.New("You can't repost your own posts.")
+	ErrRepostReply = errors.New("Reposts can't be replies.")
+	ErrRepostEdit  = errors.New("Reposts can't be edited.")
+)
+
+func (p *Post) RepostCount() int {
+	if p.Stats != nil {
+		return p.Stats.Reposts
+	}
+
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	count, _ := redis.Int(redisConn.Do("HLEN", "reposts:"+p.Id))
+	return count
+}
+
+func (p *Post) HasReposted(userId string) bool {
+	if p.viewedBy(userId) {
+		return p.Stats.Reposted
+	}
+
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	reposted, _ := redis.Bool(redisConn.Do("HEXISTS", "reposts:"+p.Id, userId))
+	return reposted
+}
+
+// resolvePost returns the post to show for the id, the reposted post for a
+// repost. Like getPost the UserId is empty when the post doesn't exist.
+func (helper *DBHelper) resolvePost(postId string) *Post {
+	post := helper.getPost(postId)
+	if helper.err != nil || post.RepostOf == "" {
+		return post
+	}
+
+	original := helper.getPost(post.RepostOf)
+	original.RepostedBy = post.UserName
+	return original
+}
+
+// deliverRepost returns the recipients who don't have the post yet and marks
+// them as having it through the repost.
+func (helper *DBHelper) deliverRepost(original *Post, repostId string, recipients []string) []string {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	key := "delivered:" + original.Id
+	delivered := []string{}
+	for _, recipient := range recipients {
+		var added bool
+		added, helper.err = redis.Bool(redisConn.Do("HSETNX", key, recipient, repostId))
+		if helper.err != nil {
+			return nil
+		}
+		if added {
+			delivered = append(delivered, recipient)
+		}
+	}
+	if len(delivered) > 0 {
+		_, helper.err = redisConn.Do("EXPIRE", key, deliveredTTL)
+	}
+	return delivered
+}
+
+// repost reposts the post for the user, reposting twice is the same as once.
+func (helper *DBHelper) repost(user *User, original *Post) {
+	helper.post(&Post{UserId: user.UserId, RepostOf: original.Id})
+}
+
+func (helper *DBHelper) unrepost(user *User, original *Post) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var repostId string
+	repostId, helper.err = redis.String(redisConn.Do("HGET", "reposts:"+original.Id, user.UserId))
+	if helper.err == redis.ErrNil {
+		helper.err = nil
+		return
+	}
+	if helper.err != nil {
+		return
+	}
+
+	repost := helper.getPost(repostId)
+	if helper.err != nil {
+		return
+	}
+	if repost.UserId == "" {
+		_, helper.err = redisConn.Do("HDEL", "reposts:"+original.Id, user.UserId)
+		return
+	}
+	helper.deletePost(repost)
+}
+
+// forgetRepost takes the repost off the post it reposted, the followers who
+// got the post through it may get it again through another repost.
+func (helper *DBHelper) forgetRepost(repost *Post) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var delivered map[string]string
+	delivered, helper.err = redis.StringMap(redisConn.Do("HGETALL", "delivered:"+repost.RepostOf))
+	if helper.err != nil {
+		return
+	}
+
+	redisConn.Send("MULTI")
+	redisConn.Send("HDEL", "reposts:"+repost.RepostOf, repost.UserId)
+	for recipient, repostId := range delivered {
+		if repostId == repost.Id {
+			redisConn.Send("HDEL", "delivered:"+repost.RepostOf, recipient)
+		}
+	}
+	_, helper.err = redisConn.Do("EXEC")
+}
+
+// redirectBack returns to the page the form was on.
+func redirectBack(w http.ResponseWriter, r *http.Request) {
+	back := "/home"
+	if referer, err := url.Parse(r.Referer()); err == nil && referer.Host == r.Host && referer.Path != "" {
+		back = referer.RequestURI()
+	}
+	http.Redirect(w, r, back, http.StatusFound)
+}
+
+// Repost Handlers
+
+func repostHandler(undo bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		helper := DBHelper{}
+		user := context.Get(r, "user").(*User)
+
+		if !checkCSRF(r, user.UserId, "post") {
+			Goback(w, r, errors.New("Your session has expired, please reload the page."))
+			return
+		}
+
+		post := helper.postParam(r)
+		if helper.err == nil && post.RepostOf != "" {
+			post = helper.resolvePost(post.Id)
+		}
+		if helper.err != nil {
+			Goback(w, r, helper.err)
+			return
+		}
+
+		if undo {
+			helper.unrepost(user, post)
+		} else if !user.CanPost() {
+			Goback(w, r, ErrUnverifiedEmail)
+			return
+		} else {
+			helper.repost(user, post)
+		}
+		if helper.err != nil {
+			Goback(w, r, helper.err)
+			return
+		}
+
+		redirectBack(w, r)
+	}
+}
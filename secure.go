@@ -1,41 +1,231 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"flag"
 	"log"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/dchest/scrypt"
 
+	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
 )
 
 const (
 	sessionName = "Auth"
 	userKey     = "UserId"
+	versionKey  = "Version"
+	pendingKey  = "Pending"
+	createdKey  = "Created"
+	seenKey     = "Seen"
+	rememberKey = "Remember"
 	saltKey     = "+acxKecey7bX3f$WwmLgku%m&+l#L0@S"
+
+	// A password login waiting for the second factor.
+	pendingTTL      = 5 * 60
+	pendingAttempts = 5
+)
+
+var (
+	cookieSecure        = flag.String("cookieSecure", "auto", "send the session cookie over https only: true, false or auto to follow baseURL")
+	cookieSameSite      = flag.String("cookieSameSite", "lax", "SameSite attribute of the session cookie: lax, strict or none")
+	cookieDomain        = flag.String("cookieDomain", "", "domain of the session cookie, defaults to the host of the request")
+	sessionIdleTimeout  = flag.Duration("sessionIdleTimeout", 2*time.Hour, "sign out sessions unused for this long")
+	rememberIdleTimeout = flag.Duration("rememberIdleTimeout", 14*24*time.Hour, "idle timeout of sessions which checked remember me")
+	sessionLifetime     = flag.Duration("sessionLifetime", 30*24*time.Hour, "sign out every session this long after the login")
 )
 
-func getUser(r *http.Request) (userId string) {
+// sessionOptions are the cookie attributes of every session.
+func sessionOptions() *sessions.Options {
+	options := &sessions.Options{
+		Path:     "/",
+		Domain:   *cookieDomain,
+		MaxAge:   int(sessionLifetime.Seconds()),
+		Secure:   *cookieSecure == "true" || *cookieSecure == "auto" && strings.HasPrefix(*baseURL, "https:"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	switch *cookieSameSite {
+	case "strict":
+		options.SameSite = http.SameSiteStrictMode
+	case "none":
+		// Browsers drop SameSite=None cookies without Secure.
+		options.SameSite = http.SameSiteNoneMode
+		options.Secure = true
+	}
+	return options
+}
+
+func getUser(r *http.Request) (userId string, version int) {
 	session, err := redisStore.Get(r, sessionName)
 	if err != nil {
 		log.Printf("err in get session %v", err)
 	}
 
 	if session.Values[userKey] == nil {
-		return ""
+		return "", 0
+	}
+	version, _ = session.Values[versionKey].(int)
+	return session.Values[userKey].(string), version
+}
+
+// setSession logs the user in with a fresh session id, whatever session the
+// browser presented is thrown away so its id can't be fixated by an attacker.
+// It is called again when the privileges of the session change.
+func setSession(auth string, remember bool, r *http.Request, w http.ResponseWriter) {
+	session, err := redisStore.Get(r, sessionName)
+	if err != nil {
+		log.Printf("err in get session %v", err)
+	}
+
+	helper := DBHelper{}
+	user := helper.loadUserInfo(auth)
+	if user == nil {
+		log.Printf("err in load user %v", helper.err)
+		return
+	}
+
+	if session.ID != "" {
+		oldUserId, _ := session.Values[userKey].(string)
+		helper.revokeSession(oldUserId, session.ID)
+		if helper.err != nil {
+			log.Printf("err in revoke session %v", helper.err)
+		}
+	}
+
+	now := time.Now().Unix()
+	session.ID = ""
+	session.Values = map[interface{}]interface{}{
+		userKey:     auth,
+		versionKey:  user.SessionVersion,
+		createdKey:  now,
+		seenKey:     now,
+		rememberKey: remember,
+	}
+
+	saveSession(r, w)
+
+	// The id is only known once the session has been saved.
+	helper.indexSession(auth, session.ID, r)
+	if helper.err != nil {
+		log.Printf("err in index session %v", helper.err)
+	}
+}
+
+// refreshSession signs out sessions past their idle timeout or lifetime and
+// otherwise records the activity, at most once a minute.
+func refreshSession(r *http.Request, w http.ResponseWriter) bool {
+	session, err := redisStore.Get(r, sessionName)
+	if err != nil {
+		log.Printf("err in get session %v", err)
+	}
+
+	now := time.Now().Unix()
+	created, _ := session.Values[createdKey].(int64)
+	seen, _ := session.Values[seenKey].(int64)
+
+	idleTimeout := *sessionIdleTimeout
+	if rememberedSession(r) {
+		idleTimeout = *rememberIdleTimeout
+	}
+
+	if now-created > int64(sessionLifetime.Seconds()) || now-seen > int64(idleTimeout.Seconds()) {
+		clearSession(r, w)
+		return false
+	}
+
+	if now-seen >= sessionTouchInterval {
+		session.Values[seenKey] = now
+		saveSession(r, w)
+	}
+	return true
+}
+
+func rememberedSession(r *http.Request) bool {
+	session, err := redisStore.Get(r, sessionName)
+	if err != nil {
+		log.Printf("err in get session %v", err)
+	}
+
+	remember, _ := session.Values[rememberKey].(bool)
+	return remember
+}
+
+func getSessionId(r *http.Request) string {
+	session, err := redisStore.Get(r, sessionName)
+	if err != nil {
+		log.Printf("err in get session %v", err)
+	}
+
+	return session.ID
+}
+
+type pendingLogin struct {
+	UserId   string
+	Next     string
+	Remember bool
+	Expires  int64
+	Attempts int
+}
+
+func init() {
+	gob.Register(&pendingLogin{})
+}
+
+// setPendingLogin remembers a user who entered the right password but still
+// has to provide the second factor.
+func setPendingLogin(userId string, next string, remember bool, r *http.Request, w http.ResponseWriter) {
+	session, err := redisStore.Get(r, sessionName)
+	if err != nil {
+		log.Printf("err in get session %v", err)
+	}
+
+	session.Values[pendingKey] = &pendingLogin{userId, next, remember, time.Now().Unix() + pendingTTL, 0}
+
+	saveSession(r, w)
+}
+
+func getPendingLogin(r *http.Request) *pendingLogin {
+	session, err := redisStore.Get(r, sessionName)
+	if err != nil {
+		log.Printf("err in get session %v", err)
+	}
+
+	pending, _ := session.Values[pendingKey].(*pendingLogin)
+	if pending == nil || pending.Expires < time.Now().Unix() || pending.Attempts >= pendingAttempts {
+		return nil
 	}
-	return session.Values[userKey].(string)
+	return pending
 }
 
-func setSession(auth string, r *http.Request, w http.ResponseWriter) {
+// failPendingLogin counts a wrong second factor and reports whether the user
+// may try again.
+func failPendingLogin(r *http.Request, w http.ResponseWriter) bool {
 	session, err := redisStore.Get(r, sessionName)
 	if err != nil {
 		log.Printf("err in get session %v", err)
 	}
 
-	session.Values[userKey] = auth
+	pending, _ := session.Values[pendingKey].(*pendingLogin)
+	if pending == nil {
+		return false
+	}
+	pending.Attempts++
+	if pending.Attempts >= pendingAttempts {
+		delete(session.Values, pendingKey)
+	}
 
 	saveSession(r, w)
+	return pending.Attempts < pendingAttempts
 }
 
 func clearSession(r *http.Request, w http.ResponseWriter) {
@@ -44,6 +234,11 @@ func clearSession(r *http.Request, w http.ResponseWriter) {
 		log.Printf("err in get session %v", err)
 	}
 
+	if userId, _ := session.Values[userKey].(string); userId != "" && session.ID != "" {
+		helper := DBHelper{}
+		helper.revokeSession(userId, session.ID)
+	}
+
 	session.Options.MaxAge = -1
 
 	saveSession(r, w)
@@ -53,9 +248,65 @@ func saveSession(r *http.Request, w http.ResponseWriter) {
 	if err := sessions.Save(r, w); err != nil {
 		log.Printf("err in get session %v", err)
 	}
+
+	session, err := redisStore.Get(r, sessionName)
+	if err != nil || session.ID == "" || session.Options.MaxAge <= 0 || rememberedSession(r) {
+		return
+	}
+
+	// redistore deletes sessions without a MaxAge, so the Redis entry keeps
+	// it and only the cookie is turned into one which ends with the browser.
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, redisStore.Codecs...)
+	if err != nil {
+		log.Printf("err in encode session %v", err)
+		return
+	}
+
+	cookies := []string{}
+	for _, cookie := range w.Header()["Set-Cookie"] {
+		if !strings.HasPrefix(cookie, session.Name()+"=") {
+			cookies = append(cookies, cookie)
+		}
+	}
+	w.Header()["Set-Cookie"] = cookies
+
+	options := *session.Options
+	options.MaxAge = 0
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, &options))
 }
 
 func encryptedPassword(password string) (string, error) {
 	dk, err := scrypt.Key([]byte(password), []byte(saltKey), 16384, 8, 1, 32)
 	return string(dk), err
 }
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// randomToken returns n random bytes encoded for use in URLs.
+func randomToken(n int) string {
+	return base64.RawURLEncoding.EncodeToString(randomBytes(n))
+}
+
+// hashToken is used to store secrets such as OAuth tokens without keeping the
+// plaintext in Redis.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// csrfToken binds a form to the logged in user and the purpose of the form.
+func csrfToken(userId string, purpose string) string {
+	mac := hmac.New(sha256.New, authKey)
+	mac.Write([]byte(purpose + ":" + userId))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func checkCSRF(r *http.Request, userId string, purpose string) bool {
+	return hmac.Equal([]byte(r.PostFormValue("csrf")), []byte(csrfToken(userId, purpose)))
+}
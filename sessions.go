@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/context"
+)
+
+// Every login session is indexed in the sessions:<userId> sorted set, scored
+// by last activity, with the details in session_info:<sessionId>. Signing a
+// session out deletes the redistore entry, which is stored under
+// sessionKeyPrefix + the session id.
+
+const (
+	sessionKeyPrefix = "session_"
+
+	// lastSeen is only written once a minute per session.
+	sessionTouchInterval = 60
+)
+
+type SessionInfo struct {
+	SessionId string `redis:"-"`
+	UserId    string `redis:"userId"`
+	UserAgent string `redis:"userAgent"`
+	IP        string `redis:"ip"`
+	Created   int64  `redis:"created"`
+	LastSeen  int64  `redis:"lastSeen"`
+	Current   bool   `redis:"-"`
+}
+
+func (s *SessionInfo) Device() string {
+	return describeUserAgent(s.UserAgent)
+}
+
+func (s *SessionInfo) LastSeenTime() string {
+	return strElapsed(strconv.FormatInt(s.LastSeen, 10))
+}
+
+func (s *SessionInfo) CreatedTime() string {
+	return strElapsed(strconv.FormatInt(s.Created, 10))
+}
+
+// describeUserAgent turns a user agent into something like "Firefox on
+// Linux", good enough to tell devices apart.
+func describeUserAgent(ua string) string {
+	browser := "Unknown browser"
+	for _, b := range [][2]string{
+		{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"}, {"Safari/", "Safari"}, {"curl/", "curl"},
+	} {
+		if strings.Contains(ua, b[0]) {
+			browser = b[1]
+			break
+		}
+	}
+
+	system := ""
+	for _, s := range [][2]string{
+		{"Android", "Android"}, {"iPhone", "iOS"}, {"iPad", "iPadOS"},
+		{"Windows", "Windows"}, {"Mac OS X", "macOS"}, {"CrOS", "ChromeOS"}, {"Linux", "Linux"},
+	} {
+		if strings.Contains(ua, s[0]) {
+			system = s[1]
+			break
+		}
+	}
+
+	if system == "" {
+		return browser
+	}
+	return browser + " on " + system
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (helper *DBHelper) indexSession(userId string, sessionId string, r *http.Request) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	ua := r.UserAgent()
+	if len(ua) > 256 {
+		ua = ua[:256]
+	}
+
+	now := time.Now().Unix()
+	info := &SessionInfo{UserId: userId, UserAgent: ua, IP: remoteIP(r), Created: now, LastSeen: now}
+
+	redisConn.Send("MULTI")
+	redisConn.Send("HMSET", redis.Args{}.Add("session_info:"+sessionId).AddFlat(info)...)
+	redisConn.Send("EXPIRE", "session_info:"+sessionId, int(sessionLifetime.Seconds()))
+	redisConn.Send("ZADD", "sessions:"+userId, now, sessionId)
+	_, helper.err = redisConn.Do("EXEC")
+}
+
+func (helper *DBHelper) touchSession(userId string, sessionId string, r *http.Request) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var lastSeen int64
+	lastSeen, helper.err = redis.Int64(redisConn.Do("ZSCORE", "sessions:"+userId, sessionId))
+	if helper.err == redis.ErrNil {
+		// Logged in before sessions were indexed.
+		helper.indexSession(userId, sessionId, r)
+		return
+	}
+
+	now := time.Now().Unix()
+	if helper.err != nil || now-lastSeen < sessionTouchInterval {
+		return
+	}
+
+	redisConn.Send("MULTI")
+	redisConn.Send("HMSET", "session_info:"+sessionId, "lastSeen", now, "ip", remoteIP(r))
+	redisConn.Send("EXPIRE", "session_info:"+sessionId, int(sessionLifetime.Seconds()))
+	redisConn.Send("ZADD", "sessions:"+userId, now, sessionId)
+	_, helper.err = redisConn.Do("EXEC")
+}
+
+// getSessions also drops the sessions which expired in the meantime.
+func (helper *DBHelper) getSessions(userId string, currentId string) []*SessionInfo {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var ids []string
+	ids, helper.err = redis.Strings(redisConn.Do("ZREVRANGE", "sessions:"+userId, 0, -1))
+
+	sessions := []*SessionInfo{}
+	for _, sessionId := range ids {
+		var (
+			values []interface{}
+			exists bool
+		)
+		exists, helper.err = redis.Bool(redisConn.Do("EXISTS", sessionKeyPrefix+sessionId))
+		if helper.err == nil && exists {
+			values, helper.err = redis.Values(redisConn.Do("HGETALL", "session_info:"+sessionId))
+		}
+		if helper.err != nil {
+			return sessions
+		}
+		if !exists || len(values) == 0 {
+			redisConn.Do("ZREM", "sessions:"+userId, sessionId)
+			continue
+		}
+
+		info := &SessionInfo{SessionId: sessionId, Current: sessionId == currentId}
+		if redis.ScanStruct(values, info) == nil {
+			sessions = append(sessions, info)
+		}
+	}
+	return sessions
+}
+
+func (helper *DBHelper) revokeSession(userId string, sessionId string) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	redisConn.Send("MULTI")
+	redisConn.Send("DEL", sessionKeyPrefix+sessionId, "session_info:"+sessionId)
+	redisConn.Send("ZREM", "sessions:"+userId, sessionId)
+	_, helper.err = redisConn.Do("EXEC")
+}
+
+// revokeOtherSessions signs out every session of the user but keepId, which
+// may be empty to sign out all of them.
+func (helper *DBHelper) revokeOtherSessions(userId string, keepId string) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var ids []string
+	ids, helper.err = redis.Strings(redisConn.Do("ZRANGE", "sessions:"+userId, 0, -1))
+	if helper.err != nil {
+		return
+	}
+
+	for _, sessionId := range ids {
+		if sessionId == keepId {
+			continue
+		}
+		helper.revokeSession(userId, sessionId)
+		if helper.err != nil {
+			return
+		}
+	}
+}
+
+// Session Handlers
+
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	templateParams := map[string]interface{}{}
+	templateParams["user"] = user
+	templateParams["sessions"] = helper.getSessions(user.UserId, getSessionId(r))
+	templateParams["csrf"] = csrfToken(user.UserId, "sessions")
+
+	tmplRender.HTML(w, http.StatusOK, "sessions", templateParams)
+}
+
+func revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	if !checkCSRF(r, user.UserId, "sessions") {
+		Goback(w, r, errors.New("Your session has expired, please reload the page."))
+		return
+	}
+
+	sessionId := r.PostFormValue("session")
+	if sessionId == getSessionId(r) {
+		http.Redirect(w, r, "/logout", http.StatusFound)
+		return
+	}
+
+	// Only sessions in the index of the user can be revoked.
+	for _, session := range helper.getSessions(user.UserId, "") {
+		if session.SessionId == sessionId {
+			helper.revokeSession(user.UserId, sessionId)
+			break
+		}
+	}
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+
+	http.Redirect(w, r, "/settings/sessions", http.StatusFound)
+}
+
+func revokeOtherSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	if !checkCSRF(r, user.UserId, "sessions") {
+		Goback(w, r, errors.New("Your session has expired, please reload the page."))
+		return
+	}
+
+	helper.revokeOtherSessions(user.UserId, getSessionId(r))
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+
+	http.Redirect(w, r, "/settings/sessions", http.StatusFound)
+}
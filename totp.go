@@ -0,0 +1,371 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/context"
+	"rsc.io/qr"
+)
+
+// Time-based one-time passwords (RFC 6238) as the second login factor, with
+// hashed single-use recovery codes for users who lost their authenticator.
+
+const (
+	totpStep          = 30
+	totpDigits        = 6
+	totpPendingTTL    = 10 * 60
+	recoveryCodeCount = 10
+)
+
+var (
+	ErrInvalidCode = errors.New("The code is wrong or has already been used, please try again.")
+
+	totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+	// totpReplayScript only accepts a time step newer than the last one used.
+	totpReplayScript = redis.NewScript(1, `
+local last = tonumber(redis.call('GET', KEYS[1]) or '-1')
+if tonumber(ARGV[1]) <= last then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1], 'EX', 300)
+return 1
+`)
+)
+
+func (u *User) HasTwoFactor() bool {
+	return u.TOTPSecret != ""
+}
+
+func totpCode(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// totpStepFor returns the time step the code belongs to, allowing one step of
+// clock drift in both directions, or -1. Anybody can compute the codes of an
+// empty secret, users without TOTP never match.
+func totpStepFor(secret string, code string) int64 {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(key) == 0 || len(code) != totpDigits {
+		return -1
+	}
+
+	now := time.Now().Unix() / totpStep
+	for _, step := range []int64{now - 1, now, now + 1} {
+		if hmac.Equal([]byte(totpCode(key, uint64(step))), []byte(code)) {
+			return step
+		}
+	}
+	return -1
+}
+
+func totpURI(user *User, secret string) string {
+	label := url.PathEscape("SimpleGo:" + user.UserName)
+	return "otpauth://totp/" + label + "?secret=" + secret + "&issuer=SimpleGo&digits=6&period=30"
+}
+
+func normalizeCode(code string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(code), " ", "", -1))
+}
+
+// pendingSecret returns the secret shown during enrollment, creating it on
+// the first call.
+func (helper *DBHelper) pendingSecret(userId string) string {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	secret := totpEncoding.EncodeToString(randomBytes(20))
+	_, helper.err = redisConn.Do("SET", "totp_pending:"+userId, secret, "EX", totpPendingTTL, "NX")
+	if helper.err != nil {
+		return ""
+	}
+
+	secret, helper.err = redis.String(redisConn.Do("GET", "totp_pending:"+userId))
+	return secret
+}
+
+func (helper *DBHelper) enableTwoFactor(userId string, code string) []string {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var secret string
+	secret, helper.err = redis.String(redisConn.Do("GET", "totp_pending:"+userId))
+	if helper.err != nil {
+		helper.err = errors.New("The enrollment has expired, please scan the new QR code.")
+		return nil
+	}
+
+	if !helper.useTOTP(userId, secret, normalizeCode(code)) {
+		return nil
+	}
+
+	_, helper.err = redisConn.Do("HSET", "user:"+userId, "totpSecret", secret)
+	if helper.err != nil {
+		return nil
+	}
+	redisConn.Do("DEL", "totp_pending:"+userId)
+
+	return helper.newRecoveryCodes(userId)
+}
+
+func (helper *DBHelper) disableTwoFactor(userId string) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	redisConn.Send("MULTI")
+	redisConn.Send("HDEL", "user:"+userId, "totpSecret")
+	redisConn.Send("DEL", "recovery_codes:"+userId, "totp_pending:"+userId)
+	_, helper.err = redisConn.Do("EXEC")
+}
+
+func (helper *DBHelper) newRecoveryCodes(userId string) []string {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	codes := []string{}
+	args := redis.Args{}.Add("recovery_codes:" + userId)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code := strings.ToLower(totpEncoding.EncodeToString(randomBytes(5)))
+		codes = append(codes, code[:4]+"-"+code[4:])
+		args = args.Add(hashToken(code))
+	}
+
+	redisConn.Send("MULTI")
+	redisConn.Send("DEL", "recovery_codes:"+userId)
+	redisConn.Send("SADD", args...)
+	_, helper.err = redisConn.Do("EXEC")
+	return codes
+}
+
+func (helper *DBHelper) useTOTP(userId string, secret string, code string) bool {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	step := totpStepFor(secret, code)
+	if step < 0 {
+		helper.err = ErrInvalidCode
+		return false
+	}
+
+	var fresh bool
+	fresh, helper.err = redis.Bool(totpReplayScript.Do(redisConn, "totp_last:"+userId, step))
+	if helper.err == nil && !fresh {
+		helper.err = ErrInvalidCode
+	}
+	return helper.err == nil
+}
+
+func (helper *DBHelper) useRecoveryCode(userId string, code string) bool {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var used bool
+	code = strings.Replace(code, "-", "", -1)
+	used, helper.err = redis.Bool(redisConn.Do("SREM", "recovery_codes:"+userId, hashToken(code)))
+	if helper.err == nil && !used {
+		helper.err = ErrInvalidCode
+	}
+	return helper.err == nil
+}
+
+func (helper *DBHelper) countRecoveryCodes(userId string) int {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var count int
+	count, helper.err = redis.Int(redisConn.Do("SCARD", "recovery_codes:"+userId))
+	return count
+}
+
+// checkSecondFactor accepts either a code from the authenticator app or one
+// of the recovery codes. Users with only passkeys have neither.
+func (helper *DBHelper) checkSecondFactor(user *User, code string) bool {
+	if !user.HasTwoFactor() {
+		helper.err = ErrInvalidCode
+		return false
+	}
+
+	code = normalizeCode(code)
+	if len(code) == totpDigits {
+		return helper.useTOTP(user.UserId, user.TOTPSecret, code)
+	}
+	return helper.useRecoveryCode(user.UserId, code)
+}
+
+// 2FA Handlers
+
+func twoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	templateParams := map[string]interface{}{}
+	templateParams["user"] = user
+	templateParams["csrf"] = csrfToken(user.UserId, "2fa")
+
+	if user.HasTwoFactor() {
+		templateParams["recovery"] = helper.countRecoveryCodes(user.UserId)
+	} else {
+		templateParams["secret"] = helper.pendingSecret(user.UserId)
+		if helper.err != nil {
+			Goback(w, r, helper.err)
+			return
+		}
+	}
+
+	tmplRender.HTML(w, http.StatusOK, "twofactor_settings", templateParams)
+}
+
+func twoFactorQRHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	secret := helper.pendingSecret(user.UserId)
+	if helper.err != nil {
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	code, err := qr.Encode(totpURI(user, secret), qr.M)
+	if err != nil {
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(code.PNG())
+}
+
+func enableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	if !checkCSRF(r, user.UserId, "2fa") {
+		Goback(w, r, errors.New("Your session has expired, please reload the page."))
+		return
+	}
+
+	codes := helper.enableTwoFactor(user.UserId, r.PostFormValue("code"))
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+	setSession(user.UserId, rememberedSession(r), r, w)
+
+	templateParams := map[string]interface{}{}
+	templateParams["user"] = user
+	templateParams["codes"] = codes
+	tmplRender.HTML(w, http.StatusOK, "recovery_codes", templateParams)
+}
+
+func disableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	if !checkCSRF(r, user.UserId, "2fa") {
+		Goback(w, r, errors.New("Your session has expired, please reload the page."))
+		return
+	}
+
+	if !helper.checkSecondFactor(user, r.PostFormValue("code")) {
+		Goback(w, r, helper.err)
+		return
+	}
+
+	helper.disableTwoFactor(user.UserId)
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+
+	http.Redirect(w, r, "/settings/2fa", http.StatusFound)
+}
+
+func recoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	if !checkCSRF(r, user.UserId, "2fa") {
+		Goback(w, r, errors.New("Your session has expired, please reload the page."))
+		return
+	}
+
+	if !helper.checkSecondFactor(user, r.PostFormValue("code")) {
+		Goback(w, r, helper.err)
+		return
+	}
+
+	codes := helper.newRecoveryCodes(user.UserId)
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+
+	templateParams := map[string]interface{}{}
+	templateParams["user"] = user
+	templateParams["codes"] = codes
+	tmplRender.HTML(w, http.StatusOK, "recovery_codes", templateParams)
+}
+
+func loginTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+
+	pending := getPendingLogin(r)
+	if pending == nil {
+		Goback(w, r, errors.New("The login has expired, please enter your password again."))
+		return
+	}
+
+	user := helper.loadUserInfo(pending.UserId)
+	if user == nil {
+		Goback(w, r, helper.err)
+		return
+	}
+
+	if !helper.checkSecondFactor(user, r.PostFormValue("code")) {
+		loginFailed(user.UserId, "password and code", r)
+		if failPendingLogin(r, w) {
+			Goback(w, r, helper.err)
+		} else {
+			Goback(w, r, errors.New("Too many wrong codes, please enter your password again."))
+		}
+		return
+	}
+
+	loginSucceeded(user.UserId, "password and code", pending.Remember, r, w)
+	http.Redirect(w, r, localPath(pending.Next), http.StatusFound)
+}
+
+func resetTwoFactorCommand(args []string) error {
+	user, err := commandUser(args)
+	if err != nil {
+		return err
+	}
+
+	// Passkeys count as a second factor as well.
+	helper := DBHelper{}
+	helper.disableTwoFactor(user.UserId)
+	if helper.err != nil {
+		return helper.err
+	}
+	helper.deletePasskeys(user.UserId)
+	return helper.err
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func currentTOTP(secret string) string {
+	key, _ := totpEncoding.DecodeString(secret)
+	return totpCode(key, uint64(time.Now().Unix()/totpStep))
+}
+
+func TestTOTPStepFor(t *testing.T) {
+	secret := totpEncoding.EncodeToString(randomBytes(20))
+	now := time.Now().Unix() / totpStep
+
+	if step := totpStepFor(secret, currentTOTP(secret)); step != now {
+		t.Errorf("current code: got step %d, want %d", step, now)
+	}
+	if step := totpStepFor(secret, "12345"); step != -1 {
+		t.Errorf("short code: got step %d", step)
+	}
+	// Anybody can compute the codes of an empty secret.
+	if step := totpStepFor("", currentTOTP("")); step != -1 {
+		t.Errorf("empty secret: got step %d", step)
+	}
+}
+
+func TestCheckSecondFactorWithoutTOTP(t *testing.T) {
+	helper := DBHelper{}
+	if helper.checkSecondFactor(&User{UserId: "1"}, currentTOTP("")) || helper.err != ErrInvalidCode {
+		t.Errorf("code for the empty secret accepted, err %v", helper.err)
+	}
+}
+
+func TestPasskeyOnlyLoginTwoFactor(t *testing.T) {
+	setupRedis(t)
+
+	userId := createTestUser(t, "alice", "correct horse battery staple")
+	authenticator := newSoftAuthenticator()
+	helper := DBHelper{}
+	helper.savePasskey(userId, &Passkey{Id: authenticator.id(), PublicKey: authenticator.coseKey(), Name: "Passkey"})
+	if helper.err != nil {
+		t.Fatal(helper.err)
+	}
+
+	browser := newTestBrowser()
+	browser.post(loginHandler, "/login", url.Values{"username": {"alice"}, "password": {"correct horse battery staple"}})
+	if browser.userId() != "" {
+		t.Fatal("signed in with the password alone")
+	}
+
+	// A code for the empty secret of a user without TOTP must not count.
+	for i := 0; i < pendingAttempts; i++ {
+		browser.post(loginTwoFactorHandler, "/login/2fa", url.Values{"code": {currentTOTP("")}})
+		if browser.userId() != "" {
+			t.Fatal("signed in with a TOTP code instead of the passkey")
+		}
+	}
+}
@@ -10,7 +10,22 @@ type User struct {
 	UserId   string `redis:"userId"`
 	UserName string `redis:"userName"`
 	Password string `redis:"password"`
-	err      error
+	Email    string `redis:"email"`
+
+	DisplayName string `redis:"displayName"`
+	Bio         string `redis:"bio"`
+	Location    string `redis:"location"`
+	Website     string `redis:"website"`
+	Avatar      string `redis:"avatar"`
+	Header      string `redis:"header"`
+
+	EmailVerified bool   `redis:"emailVerified"`
+	TOTPSecret    string `redis:"totpSecret"`
+
+	// SessionVersion is stored in every session of the user, bumping it
+	// signs all of them out.
+	SessionVersion int `redis:"sessionVersion"`
+	err            error
 }
 
 func (u *User) IsEqual(user *User) bool {
@@ -27,7 +42,7 @@ func (u *User) IsEqual(user *User) bool {
 
 func (u *User) IsFollowing(user *User) bool {
 	redisConn := redisPool.Get()
-	redisConn.Close()
+	defer redisConn.Close()
 
 	var v int
 	v, u.err = redis.Int(redisConn.Do("ZSCORE", "following:"+u.UserId, user.UserId))
@@ -44,7 +59,7 @@ func (u *User) IsFollowing(user *User) bool {
 
 func (u *User) GetFollowers() int {
 	redisConn := redisPool.Get()
-	redisConn.Close()
+	defer redisConn.Close()
 
 	var count int
 	count, u.err = redis.Int(redisConn.Do("ZCARD", "followers:"+u.UserId))
@@ -60,7 +75,7 @@ func (u *User) GetFollowers() int {
 func (u *User) GetFollowing() int {
 
 	redisConn := redisPool.Get()
-	redisConn.Close()
+	defer redisConn.Close()
 
 	var count int
 	count, u.err = redis.Int(redisConn.Do("ZCARD", "following:"+u.UserId))
@@ -74,7 +89,7 @@ func (u *User) GetFollowing() int {
 
 func (u *User) Follow(user *User) {
 	redisConn := redisPool.Get()
-	redisConn.Close()
+	defer redisConn.Close()
 
 	_, u.err = redisConn.Do("ZADD", "following:"+u.UserId, time.Now().Unix(), user.UserId)
 	_, u.err = redisConn.Do("ZADD", "followers:"+user.UserId, time.Now().Unix(), u.UserId)
@@ -82,7 +97,7 @@ func (u *User) Follow(user *User) {
 
 func (u *User) UnFollow(user *User) {
 	redisConn := redisPool.Get()
-	redisConn.Close()
+	defer redisConn.Close()
 
 	_, u.err = redisConn.Do("ZREM", "following:"+u.UserId, user.UserId)
 	_, u.err = redisConn.Do("ZREM", "followers:"+user.UserId, u.UserId)
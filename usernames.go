@@ -0,0 +1,311 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/context"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// The users hash maps the key of every username to the user id. The key is
+// the NFKC normalized, case folded name with look-alike characters replaced,
+// so "Alice", "alice" and "аlice" (with a Cyrillic a) are the same name. The
+// name as typed at registration is kept in user:<id> for display.
+//
+// After a rename renamed:<old key> holds the user id for renameGracePeriod,
+// nobody else can take the old name meanwhile and its profile redirects.
+
+const (
+	userNameMinLength = 3
+	userNameMaxLength = 20
+)
+
+var (
+	renameGracePeriod = flag.Duration("renameGracePeriod", 30*24*time.Hour, "how long an old username stays reserved and redirects after a rename")
+
+	ErrUserNameLength   = fmt.Errorf("Usernames need between %d and %d characters.", userNameMinLength, userNameMaxLength)
+	ErrUserNameChars    = errors.New("Usernames may only contain letters, digits and underscores, and must start with a letter or digit.")
+	ErrUserNameScripts  = errors.New("Usernames must not mix letters of different alphabets.")
+	ErrUserNameReserved = errors.New("Sorry, this username is reserved.")
+
+	reservedUserNames = map[string]bool{}
+
+	caseFolder = cases.Fold()
+
+	// confusables maps characters to the ones they are easily taken for,
+	// after case folding. It covers the usual suspects, not all of Unicode's
+	// confusables.txt.
+	confusables = strings.NewReplacer(
+		// Cyrillic
+		"а", "a", "в", "b", "е", "e", "ё", "e", "һ", "h", "і", "l", "ї", "l", "ј", "j",
+		"к", "k", "м", "m", "н", "h", "о", "o", "р", "p", "с", "c", "т", "t",
+		"у", "y", "х", "x", "ѕ", "s", "ԁ", "d", "ԛ", "q", "ԝ", "w", "ь", "b",
+		// Greek
+		"α", "a", "β", "b", "ε", "e", "η", "n", "ι", "l", "κ", "k", "ν", "v",
+		"ο", "o", "ρ", "p", "τ", "t", "υ", "u", "χ", "x", "ω", "w",
+		// Latin and digits
+		"rn", "m", "vv", "w", "0", "o", "1", "l", "i", "l", "5", "s", "ı", "l",
+	)
+
+	// claimUserScript takes the username and creates the user in one step,
+	// so two registrations can never get the same name.
+	claimUserScript = redis.NewScript(3, `
+if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 1 or redis.call('EXISTS', 'renamed:' .. ARGV[1]) == 1 then
+	return false
+end
+local id = redis.call('INCR', KEYS[2])
+redis.call('HSET', KEYS[1], ARGV[1], id)
+redis.call('HMSET', 'user:' .. id, 'userId', id, 'userName', ARGV[2], 'password', ARGV[3])
+redis.call('ZADD', KEYS[3], ARGV[4], ARGV[2])
+return id
+`)
+
+	// renameUserScript moves the user to the new name and reserves the old
+	// one. Renaming back to a reserved name of the same user is allowed.
+	renameUserScript = redis.NewScript(5, `
+local owner = redis.call('HGET', KEYS[1], ARGV[2])
+if owner and owner ~= ARGV[1] then
+	return 0
+end
+local holder = redis.call('GET', KEYS[4])
+if holder and holder ~= ARGV[1] then
+	return 0
+end
+for _, name in ipairs({ARGV[5], ARGV[4]}) do
+	if redis.call('HGET', KEYS[1], name) == ARGV[1] then
+		redis.call('HDEL', KEYS[1], name)
+	end
+end
+redis.call('HSET', KEYS[1], ARGV[2], ARGV[1])
+redis.call('HSET', KEYS[2], 'userName', ARGV[3])
+local score = redis.call('ZSCORE', KEYS[3], ARGV[4])
+if score then
+	redis.call('ZREM', KEYS[3], ARGV[4])
+	redis.call('ZADD', KEYS[3], score, ARGV[3])
+end
+redis.call('DEL', KEYS[4])
+if KEYS[5] ~= KEYS[4] then
+	redis.call('SET', KEYS[5], ARGV[1], 'EX', ARGV[6])
+end
+return 1
+`)
+)
+
+func init() {
+	for _, name := range []string{
+		"admin", "administrator", "root", "system", "support", "help", "security",
+		"api", "oauth", "webauthn", "media", "static", "www", "mail", "noreply",
+		"home", "timeline", "login", "logout", "register", "settings", "profile",
+		"post", "posts", "notifications", "invites", "verify", "reset", "forgot",
+		"me", "null", "undefined", "anonymous", "everyone",
+	} {
+		reservedUserNames[userNameKey(name)] = true
+	}
+}
+
+// userNameKey is what two usernames must differ in.
+func userNameKey(userName string) string {
+	return confusables.Replace(caseFolder.String(norm.NFKC.String(userName)))
+}
+
+// parseUserName applies the username policy and returns the name to show.
+func parseUserName(userName string) (string, error) {
+	userName = norm.NFKC.String(strings.TrimSpace(userName))
+
+	length := utf8.RuneCountInString(userName)
+	if length < userNameMinLength || length > userNameMaxLength {
+		return "", ErrUserNameLength
+	}
+
+	var script *unicode.RangeTable
+	for i, c := range userName {
+		if c == '_' && i > 0 {
+			continue
+		}
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) {
+			return "", ErrUserNameChars
+		}
+
+		// Only these alphabets have letters which look alike.
+		for _, table := range []*unicode.RangeTable{unicode.Latin, unicode.Greek, unicode.Cyrillic} {
+			if !unicode.Is(table, c) {
+				continue
+			}
+			if script != nil && script != table {
+				return "", ErrUserNameScripts
+			}
+			script = table
+		}
+	}
+
+	if reservedUserNames[userNameKey(userName)] {
+		return "", ErrUserNameReserved
+	}
+	return userName, nil
+}
+
+// getUserId finds the user by name. The exact name is tried first for the
+// accounts migrate-usernames couldn't move to their key.
+func (helper *DBHelper) getUserId(userName string) string {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var values []interface{}
+	values, helper.err = redis.Values(redisConn.Do("HMGET", "users", userName, userNameKey(userName)))
+	if helper.err != nil {
+		return ""
+	}
+
+	for _, value := range values {
+		if value != nil {
+			return string(value.([]byte))
+		}
+	}
+	helper.err = redis.ErrNil
+	return ""
+}
+
+func migrateUserNamesCommand(args []string) error {
+	if len(args) > 1 || len(args) == 1 && args[0] != "-apply" {
+		return errors.New("wrong arguments")
+	}
+	apply := len(args) == 1
+
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	names, err := redis.StringMap(redisConn.Do("HGETALL", "users"))
+	if err != nil {
+		return err
+	}
+
+	byKey := map[string][]string{}
+	for name := range names {
+		key := userNameKey(name)
+		byKey[key] = append(byKey[key], name)
+	}
+
+	keys := []string{}
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	moved, collisions := 0, 0
+	for _, key := range keys {
+		group := byKey[key]
+		if len(group) > 1 {
+			// The account already stored under the key keeps it, otherwise
+			// the oldest one gets it. The others keep their exact name until
+			// they are renamed.
+			sort.Slice(group, func(i, j int) bool {
+				if group[i] == key || group[j] == key {
+					return group[i] == key
+				}
+				a, _ := strconv.Atoi(names[group[i]])
+				b, _ := strconv.Atoi(names[group[j]])
+				return a < b
+			})
+			collisions++
+			fmt.Printf("collision on %q:", key)
+			for _, name := range group {
+				fmt.Printf(" %q (user %s)", name, names[name])
+			}
+			fmt.Println()
+		}
+
+		name := group[0]
+		if name == key {
+			continue
+		}
+		moved++
+		if !apply {
+			continue
+		}
+
+		redisConn.Send("MULTI")
+		redisConn.Send("HDEL", "users", name)
+		redisConn.Send("HSET", "users", key, names[name])
+		if _, err := redisConn.Do("EXEC"); err != nil {
+			return err
+		}
+	}
+
+	if apply {
+		fmt.Printf("%d usernames moved to their key, %d collisions\n", moved, collisions)
+	} else {
+		fmt.Printf("%d usernames to move, %d collisions, run with -apply to move them\n", moved, collisions)
+	}
+	return nil
+}
+
+func (helper *DBHelper) renameUser(user *User, userName string) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	oldKey, newKey := userNameKey(user.UserName), userNameKey(userName)
+
+	var renamed bool
+	renamed, helper.err = redis.Bool(renameUserScript.Do(redisConn,
+		"users", "user:"+user.UserId, "users_by_time", "renamed:"+newKey, "renamed:"+oldKey,
+		user.UserId, newKey, userName, user.UserName, oldKey, int(renameGracePeriod.Seconds())))
+	if helper.err == nil && !renamed {
+		helper.err = ErrUserNameTaken
+	}
+}
+
+// getRenamedUser returns the user who recently gave up the name.
+func (helper *DBHelper) getRenamedUser(userName string) *User {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var userId string
+	userId, helper.err = redis.String(redisConn.Do("GET", "renamed:"+userNameKey(userName)))
+	if helper.err != nil {
+		return nil
+	}
+
+	return helper.loadUserInfo(userId)
+}
+
+// Username Handlers
+
+func renameHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	if !checkCSRF(r, user.UserId, "settings") {
+		Goback(w, r, errors.New("Your session has expired, please reload the page."))
+		return
+	}
+
+	userName, err := parseUserName(r.PostFormValue("username"))
+	if err != nil {
+		Goback(w, r, err)
+		return
+	}
+
+	if userName == user.UserName {
+		http.Redirect(w, r, "/settings", http.StatusFound)
+		return
+	}
+
+	helper.renameUser(user, userName)
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+
+	http.Redirect(w, r, "/settings", http.StatusFound)
+}
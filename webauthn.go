@@ -0,0 +1,629 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/context"
+)
+
+// WebAuthn passkeys (https://www.w3.org/TR/webauthn-2/). Only the "none"
+// attestation is requested, so attestation statements are not verified.
+// Credentials are stored per user in webauthn_credentials:<userId> and the
+// owner of every credential in the webauthn_owners hash.
+
+const webauthnChallengeTTL = 5 * 60
+
+var (
+	webauthnRPID   = flag.String("webauthnRPID", "", "relying party id for passkeys, defaults to the host of baseURL")
+	webauthnOrigin = flag.String("webauthnOrigin", "", "origin passkey ceremonies must come from, defaults to baseURL")
+
+	ErrPasskey = &Error{"passkey_failed", 400, "Bad Request", "The passkey could not be verified."}
+
+	errPasskey = errors.New("The passkey could not be verified.")
+)
+
+const (
+	coseAlgES256 = -7
+	coseAlgRS256 = -257
+
+	authDataUserPresent  = 0x01
+	authDataUserVerified = 0x04
+	authDataAttested     = 0x40
+)
+
+func rpID() string {
+	if *webauthnRPID != "" {
+		return *webauthnRPID
+	}
+	u, err := url.Parse(*baseURL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+func rpOrigin() string {
+	if *webauthnOrigin != "" {
+		return *webauthnOrigin
+	}
+	u, err := url.Parse(*baseURL)
+	if err != nil {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+type Passkey struct {
+	Id        string `json:"id"`
+	PublicKey []byte `json:"publicKey"`
+	SignCount uint32 `json:"signCount"`
+	Name      string `json:"name"`
+	Created   int64  `json:"created"`
+	LastUsed  int64  `json:"lastUsed"`
+}
+
+func (p *Passkey) CreatedTime() string {
+	return strElapsed(strconv.FormatInt(p.Created, 10))
+}
+
+func (p *Passkey) LastUsedTime() string {
+	if p.LastUsed == 0 {
+		return ""
+	}
+	return strElapsed(strconv.FormatInt(p.LastUsed, 10))
+}
+
+// The JSON the browser side sends back, every binary field is base64url.
+type credentialResponse struct {
+	Id                string `json:"id"`
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AttestationObject string `json:"attestationObject"`
+	AuthenticatorData string `json:"authenticatorData"`
+	Signature         string `json:"signature"`
+	UserHandle        string `json:"userHandle"`
+	Name              string `json:"name"`
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type authenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	CredentialId []byte
+	PublicKey    []byte
+}
+
+func b64(s string) []byte {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, errPasskey
+	}
+	ad := &authenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+
+	if ad.Flags&authDataAttested != 0 {
+		rest := data[37:]
+		if len(rest) < 18 {
+			return nil, errPasskey
+		}
+		n := int(binary.BigEndian.Uint16(rest[16:18]))
+		if len(rest) < 18+n {
+			return nil, errPasskey
+		}
+		ad.CredentialId = rest[18 : 18+n]
+
+		_, used, err := decodeCBOR(rest[18+n:])
+		if err != nil {
+			return nil, errPasskey
+		}
+		ad.PublicKey = rest[18+n : 18+n+used]
+	}
+
+	rpIDHash := sha256.Sum256([]byte(rpID()))
+	if !bytes.Equal(ad.RPIDHash, rpIDHash[:]) || ad.Flags&authDataUserPresent == 0 {
+		return nil, errPasskey
+	}
+	return ad, nil
+}
+
+func coseInt(m map[interface{}]interface{}, k int64) (int64, bool) {
+	v, ok := m[k].(int64)
+	return v, ok
+}
+
+func coseBytes(m map[interface{}]interface{}, k int64) []byte {
+	v, _ := m[k].([]byte)
+	return v
+}
+
+// parseCOSEKey supports ES256 on P-256 and RS256 keys.
+func parseCOSEKey(data []byte) (crypto.PublicKey, error) {
+	v, _, err := decodeCBOR(data)
+	if err != nil {
+		return nil, errPasskey
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, errPasskey
+	}
+
+	kty, _ := coseInt(m, 1)
+	alg, _ := coseInt(m, 3)
+	switch {
+	case kty == 2 && alg == coseAlgES256:
+		crv, _ := coseInt(m, -1)
+		x, y := coseBytes(m, -2), coseBytes(m, -3)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, errPasskey
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errPasskey
+		}
+		return key, nil
+	case kty == 3 && alg == coseAlgRS256:
+		n, e := coseBytes(m, -1), coseBytes(m, -2)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, errPasskey
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	}
+	return nil, errPasskey
+}
+
+func verifyAssertion(publicKey []byte, authData []byte, clientDataJSON []byte, signature []byte) bool {
+	key, err := parseCOSEKey(publicKey)
+	if err != nil {
+		return false
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(key, digest[:], signature)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+	}
+	return false
+}
+
+// checkClientData takes the challenge out of Redis, so every challenge can be
+// answered once. It returns what the challenge was issued for.
+func (helper *DBHelper) checkClientData(raw []byte, ceremony string) string {
+	var data clientData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		helper.err = errPasskey
+		return ""
+	}
+
+	issued := helper.takeToken("webauthn", data.Challenge)
+	if helper.err != nil {
+		helper.err = errPasskey
+		return ""
+	}
+
+	parts := strings.SplitN(issued, " ", 2)
+	if data.Type != ceremony || data.Origin != rpOrigin() || len(parts) != 2 {
+		helper.err = errPasskey
+		return ""
+	}
+	return issued
+}
+
+func (helper *DBHelper) getPasskeys(userId string) []*Passkey {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var values map[string]string
+	values, helper.err = redis.StringMap(redisConn.Do("HGETALL", "webauthn_credentials:"+userId))
+
+	passkeys := []*Passkey{}
+	for _, v := range values {
+		passkey := &Passkey{}
+		if json.Unmarshal([]byte(v), passkey) == nil {
+			passkeys = append(passkeys, passkey)
+		}
+	}
+	sort.Slice(passkeys, func(i, j int) bool { return passkeys[i].Created < passkeys[j].Created })
+	return passkeys
+}
+
+func (helper *DBHelper) getPasskey(userId string, id string) *Passkey {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var value []byte
+	value, helper.err = redis.Bytes(redisConn.Do("HGET", "webauthn_credentials:"+userId, id))
+	if helper.err != nil {
+		return nil
+	}
+
+	passkey := &Passkey{}
+	helper.err = json.Unmarshal(value, passkey)
+	if helper.err != nil {
+		return nil
+	}
+	return passkey
+}
+
+func (helper *DBHelper) getPasskeyOwner(id string) string {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var userId string
+	userId, helper.err = redis.String(redisConn.Do("HGET", "webauthn_owners", id))
+	return userId
+}
+
+func (helper *DBHelper) savePasskey(userId string, passkey *Passkey) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var value []byte
+	value, helper.err = json.Marshal(passkey)
+	if helper.err != nil {
+		return
+	}
+
+	redisConn.Send("MULTI")
+	redisConn.Send("HSET", "webauthn_credentials:"+userId, passkey.Id, value)
+	redisConn.Send("HSET", "webauthn_owners", passkey.Id, userId)
+	_, helper.err = redisConn.Do("EXEC")
+}
+
+func (helper *DBHelper) deletePasskey(userId string, id string) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var deleted bool
+	deleted, helper.err = redis.Bool(redisConn.Do("HDEL", "webauthn_credentials:"+userId, id))
+	if helper.err == nil && deleted {
+		_, helper.err = redisConn.Do("HDEL", "webauthn_owners", id)
+	}
+}
+
+func (helper *DBHelper) deletePasskeys(userId string) {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	passkeys := helper.getPasskeys(userId)
+	redisConn.Send("MULTI")
+	for _, passkey := range passkeys {
+		redisConn.Send("HDEL", "webauthn_owners", passkey.Id)
+	}
+	redisConn.Send("DEL", "webauthn_credentials:"+userId)
+	_, helper.err = redisConn.Do("EXEC")
+}
+
+func (u *User) HasPasskeys() bool {
+	redisConn := redisPool.Get()
+	defer redisConn.Close()
+
+	var count int
+	count, u.err = redis.Int(redisConn.Do("HLEN", "webauthn_credentials:"+u.UserId))
+	return count > 0
+}
+
+// NeedsSecondFactor tells whether a password login has to be confirmed with
+// a TOTP code or a passkey.
+func (u *User) NeedsSecondFactor() bool {
+	return u.HasTwoFactor() || u.HasPasskeys()
+}
+
+func (helper *DBHelper) registerPasskey(user *User, resp *credentialResponse) {
+	rawClientData := b64(resp.ClientDataJSON)
+	issued := helper.checkClientData(rawClientData, "webauthn.create")
+	if helper.err != nil {
+		return
+	}
+	if issued != "register "+user.UserId {
+		helper.err = errPasskey
+		return
+	}
+
+	v, _, err := decodeCBOR(b64(resp.AttestationObject))
+	attestation, _ := v.(map[interface{}]interface{})
+	rawAuthData, _ := attestation["authData"].([]byte)
+	if err != nil || rawAuthData == nil {
+		helper.err = errPasskey
+		return
+	}
+
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil || authData.CredentialId == nil {
+		helper.err = errPasskey
+		return
+	}
+
+	id := base64.RawURLEncoding.EncodeToString(authData.CredentialId)
+	if id != strings.TrimRight(resp.Id, "=") {
+		helper.err = errPasskey
+		return
+	}
+	if _, err := parseCOSEKey(authData.PublicKey); err != nil {
+		helper.err = errors.New("This passkey uses an algorithm we don't support.")
+		return
+	}
+
+	if helper.getPasskeyOwner(id) != "" {
+		helper.err = errors.New("This passkey is already registered.")
+		return
+	}
+
+	name := strings.TrimSpace(resp.Name)
+	if name == "" {
+		name = "Passkey"
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+
+	helper.savePasskey(user.UserId, &Passkey{
+		Id:        id,
+		PublicKey: authData.PublicKey,
+		SignCount: authData.SignCount,
+		Name:      name,
+		Created:   time.Now().Unix(),
+	})
+}
+
+// authenticatePasskey verifies an assertion and returns the id of the user
+// it belongs to. Passwordless logins also require user verification.
+func (helper *DBHelper) authenticatePasskey(resp *credentialResponse, ceremony string) string {
+	rawClientData := b64(resp.ClientDataJSON)
+	issued := helper.checkClientData(rawClientData, "webauthn.get")
+	if helper.err != nil {
+		return ""
+	}
+	parts := strings.SplitN(issued, " ", 2)
+	if parts[0] != ceremony {
+		helper.err = errPasskey
+		return ""
+	}
+
+	id := strings.TrimRight(resp.Id, "=")
+	userId := helper.getPasskeyOwner(id)
+	if helper.err != nil {
+		helper.err = errPasskey
+		return ""
+	}
+	if (parts[1] != "" && parts[1] != userId) || (resp.UserHandle != "" && string(b64(resp.UserHandle)) != userId) {
+		helper.err = errPasskey
+		return ""
+	}
+
+	passkey := helper.getPasskey(userId, id)
+	if passkey == nil {
+		helper.err = errPasskey
+		return ""
+	}
+
+	rawAuthData := b64(resp.AuthenticatorData)
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil || (ceremony == "login" && authData.Flags&authDataUserVerified == 0) {
+		helper.err = errPasskey
+		return ""
+	}
+
+	if !verifyAssertion(passkey.PublicKey, rawAuthData, rawClientData, b64(resp.Signature)) {
+		helper.err = errPasskey
+		return ""
+	}
+
+	// A counter that doesn't move forward means the authenticator may have
+	// been cloned. Authenticators that don't count always report zero.
+	if (authData.SignCount != 0 || passkey.SignCount != 0) && authData.SignCount <= passkey.SignCount {
+		helper.err = errors.New("This passkey reported an unexpected signature counter and may have been cloned.")
+		return ""
+	}
+
+	passkey.SignCount = authData.SignCount
+	passkey.LastUsed = time.Now().Unix()
+	helper.savePasskey(userId, passkey)
+	return userId
+}
+
+func creationOptions(user *User, challenge string, passkeys []*Passkey) map[string]interface{} {
+	exclude := []map[string]string{}
+	for _, p := range passkeys {
+		exclude = append(exclude, map[string]string{"type": "public-key", "id": p.Id})
+	}
+
+	return map[string]interface{}{
+		"challenge": challenge,
+		"rp":        map[string]string{"id": rpID(), "name": "SimpleGo"},
+		"user": map[string]string{
+			"id":          base64.RawURLEncoding.EncodeToString([]byte(user.UserId)),
+			"name":        user.UserName,
+			"displayName": user.UserName,
+		},
+		"pubKeyCredParams": []map[string]interface{}{
+			{"type": "public-key", "alg": coseAlgES256},
+			{"type": "public-key", "alg": coseAlgRS256},
+		},
+		"excludeCredentials": exclude,
+		"authenticatorSelection": map[string]string{
+			"residentKey":      "preferred",
+			"userVerification": "preferred",
+		},
+		"attestation": "none",
+		"timeout":     webauthnChallengeTTL * 1000,
+	}
+}
+
+func requestOptions(challenge string, passkeys []*Passkey, userVerification string) map[string]interface{} {
+	allow := []map[string]string{}
+	for _, p := range passkeys {
+		allow = append(allow, map[string]string{"type": "public-key", "id": p.Id})
+	}
+
+	return map[string]interface{}{
+		"challenge":        challenge,
+		"rpId":             rpID(),
+		"allowCredentials": allow,
+		"userVerification": userVerification,
+		"timeout":          webauthnChallengeTTL * 1000,
+	}
+}
+
+// Passkey Handlers
+
+func passkeysHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	templateParams := map[string]interface{}{}
+	templateParams["user"] = user
+	templateParams["passkeys"] = helper.getPasskeys(user.UserId)
+	templateParams["csrf"] = csrfToken(user.UserId, "passkeys")
+
+	tmplRender.HTML(w, http.StatusOK, "passkeys", templateParams)
+}
+
+func deletePasskeyHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	if !checkCSRF(r, user.UserId, "passkeys") {
+		Goback(w, r, errors.New("Your session has expired, please reload the page."))
+		return
+	}
+
+	helper.deletePasskey(user.UserId, r.PostFormValue("id"))
+	if helper.err != nil {
+		Goback(w, r, helper.err)
+		return
+	}
+
+	http.Redirect(w, r, "/settings/passkeys", http.StatusFound)
+}
+
+func beginPasskeyRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+
+	passkeys := helper.getPasskeys(user.UserId)
+	challenge := helper.createToken("webauthn", "register "+user.UserId, webauthnChallengeTTL)
+	if helper.err != nil {
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	tmplRender.JSON(w, http.StatusOK, Response{"ok", creationOptions(user, challenge, passkeys)})
+}
+
+func finishPasskeyRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	user := context.Get(r, "user").(*User)
+	resp := context.Get(r, "body").(*credentialResponse)
+
+	helper.registerPasskey(user, resp)
+	if helper.err != nil {
+		WriteError(w, &Error{ErrPasskey.Id, ErrPasskey.Status, ErrPasskey.Title, helper.err.Error()})
+		return
+	}
+
+	tmplRender.JSON(w, http.StatusOK, Response{"ok", map[string]string{"redirect": "/settings/passkeys"}})
+}
+
+func beginPasskeyLoginHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+
+	challenge := helper.createToken("webauthn", "login ", webauthnChallengeTTL)
+	if helper.err != nil {
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	tmplRender.JSON(w, http.StatusOK, Response{"ok", requestOptions(challenge, nil, "required")})
+}
+
+func finishPasskeyLoginHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	resp := context.Get(r, "body").(*credentialResponse)
+
+	// A passkey with user verification is already two factors.
+	userId := helper.authenticatePasskey(resp, "login")
+	if helper.err != nil {
+		WriteError(w, &Error{ErrPasskey.Id, ErrPasskey.Status, ErrPasskey.Title, helper.err.Error()})
+		return
+	}
+
+	loginSucceeded(userId, "passkey", r.FormValue("remember") != "", r, w)
+	tmplRender.JSON(w, http.StatusOK, Response{"ok", map[string]string{"redirect": localPath(r.FormValue("next"))}})
+}
+
+func beginPasskeySecondFactorHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+
+	pending := getPendingLogin(r)
+	if pending == nil {
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+
+	passkeys := helper.getPasskeys(pending.UserId)
+	challenge := helper.createToken("webauthn", "2fa "+pending.UserId, webauthnChallengeTTL)
+	if helper.err != nil {
+		WriteError(w, ErrInternalServer)
+		return
+	}
+
+	tmplRender.JSON(w, http.StatusOK, Response{"ok", requestOptions(challenge, passkeys, "discouraged")})
+}
+
+func finishPasskeySecondFactorHandler(w http.ResponseWriter, r *http.Request) {
+	helper := DBHelper{}
+	resp := context.Get(r, "body").(*credentialResponse)
+
+	pending := getPendingLogin(r)
+	if pending == nil {
+		WriteError(w, ErrUnauthorized)
+		return
+	}
+
+	if helper.authenticatePasskey(resp, "2fa") != pending.UserId {
+		loginFailed(pending.UserId, "password and passkey", r)
+		failPendingLogin(r, w)
+		WriteError(w, ErrPasskey)
+		return
+	}
+
+	loginSucceeded(pending.UserId, "password and passkey", pending.Remember, r, w)
+	tmplRender.JSON(w, http.StatusOK, Response{"ok", map[string]string{"redirect": localPath(pending.Next)}})
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// softAuthenticator is a passkey in software, it answers the ceremonies like
+// a browser and an authenticator would together.
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialId []byte
+	signCount    uint32
+	flags        byte
+}
+
+func newSoftAuthenticator() *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return &softAuthenticator{
+		key:          key,
+		credentialId: randomBytes(16),
+		flags:        authDataUserPresent | authDataUserVerified,
+	}
+}
+
+func (a *softAuthenticator) id() string {
+	return base64.RawURLEncoding.EncodeToString(a.credentialId)
+}
+
+func (a *softAuthenticator) coseKey() []byte {
+	return cborMap(
+		cborInt(1), cborInt(2),
+		cborInt(3), cborInt(coseAlgES256),
+		cborInt(-1), cborInt(1),
+		cborInt(-2), cborBytes(a.key.X.FillBytes(make([]byte, 32))),
+		cborInt(-3), cborBytes(a.key.Y.FillBytes(make([]byte, 32))),
+	)
+}
+
+func (a *softAuthenticator) authData(attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID()))
+	data := append([]byte{}, rpIDHash[:]...)
+
+	flags := a.flags
+	if attested {
+		flags |= authDataAttested
+	}
+	var count [4]byte
+	binary.BigEndian.PutUint32(count[:], a.signCount)
+	data = append(append(data, flags), count[:]...)
+
+	if attested {
+		var length [2]byte
+		binary.BigEndian.PutUint16(length[:], uint16(len(a.credentialId)))
+		data = append(data, make([]byte, 16)...)
+		data = append(append(data, length[:]...), a.credentialId...)
+		data = append(data, a.coseKey()...)
+	}
+	return data
+}
+
+func (a *softAuthenticator) clientData(ceremony string, challenge string) []byte {
+	data, _ := json.Marshal(&clientData{Type: ceremony, Challenge: challenge, Origin: rpOrigin()})
+	return data
+}
+
+func (a *softAuthenticator) register(challenge string) *credentialResponse {
+	attestation := cborMap(
+		cborText("fmt"), cborText("none"),
+		cborText("attStmt"), cborMap(),
+		cborText("authData"), cborBytes(a.authData(true)),
+	)
+	return &credentialResponse{
+		Id:                a.id(),
+		ClientDataJSON:    base64.RawURLEncoding.EncodeToString(a.clientData("webauthn.create", challenge)),
+		AttestationObject: base64.RawURLEncoding.EncodeToString(attestation),
+		Name:              "Test key",
+	}
+}
+
+// assert signs the challenge, counting the signature first.
+func (a *softAuthenticator) assert(challenge string, userId string) *credentialResponse {
+	a.signCount++
+	authData := a.authData(false)
+	clientData := a.clientData("webauthn.get", challenge)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		panic(err)
+	}
+
+	return &credentialResponse{
+		Id:                a.id(),
+		ClientDataJSON:    base64.RawURLEncoding.EncodeToString(clientData),
+		AuthenticatorData: base64.RawURLEncoding.EncodeToString(authData),
+		Signature:         base64.RawURLEncoding.EncodeToString(signature),
+		UserHandle:        base64.RawURLEncoding.EncodeToString([]byte(userId)),
+	}
+}
+
+// registerTestPasskey runs the registration ceremony for the user.
+func registerTestPasskey(t *testing.T, userId string) *softAuthenticator {
+	t.Helper()
+
+	helper := DBHelper{}
+	user := helper.loadUserInfo(userId)
+	if user == nil {
+		t.Fatal(helper.err)
+	}
+
+	authenticator := newSoftAuthenticator()
+	challenge := helper.createToken("webauthn", "register "+userId, webauthnChallengeTTL)
+	helper.registerPasskey(user, authenticator.register(challenge))
+	if helper.err != nil {
+		t.Fatalf("register passkey: %v", helper.err)
+	}
+	return authenticator
+}
+
+func TestPasskeyRegistration(t *testing.T) {
+	setupRedis(t)
+
+	userId := createTestUser(t, "alice", "correct horse battery staple")
+	authenticator := registerTestPasskey(t, userId)
+
+	helper := DBHelper{}
+	passkeys := helper.getPasskeys(userId)
+	if len(passkeys) != 1 || passkeys[0].Id != authenticator.id() || passkeys[0].Name != "Test key" {
+		t.Fatalf("got passkeys %+v", passkeys)
+	}
+	if owner := helper.getPasskeyOwner(authenticator.id()); owner != userId {
+		t.Errorf("passkey owned by %q, want %q", owner, userId)
+	}
+
+	// A challenge can be answered once, and only by the user it was issued to.
+	user := helper.loadUserInfo(userId)
+	challenge := helper.createToken("webauthn", "register "+userId, webauthnChallengeTTL)
+	response := newSoftAuthenticator().register(challenge)
+	helper.registerPasskey(user, response)
+	if helper.err != nil {
+		t.Fatalf("second passkey: %v", helper.err)
+	}
+	helper.registerPasskey(user, response)
+	if helper.err == nil {
+		t.Error("challenge answered twice")
+	}
+
+	bob := &User{UserId: createTestUser(t, "bob", "correct horse battery staple")}
+	helper.err = nil
+	challenge = helper.createToken("webauthn", "register "+userId, webauthnChallengeTTL)
+	helper.registerPasskey(bob, newSoftAuthenticator().register(challenge))
+	if helper.err == nil {
+		t.Error("registered a passkey with the challenge of another user")
+	}
+}
+
+func TestPasskeyLogin(t *testing.T) {
+	setupRedis(t)
+
+	userId := createTestUser(t, "alice", "correct horse battery staple")
+	authenticator := registerTestPasskey(t, userId)
+
+	browser := newTestBrowser()
+	w := browser.post(beginPasskeyLoginHandler, "/webauthn/login/begin", nil)
+	var begin struct {
+		Content struct {
+			Challenge        string `json:"challenge"`
+			UserVerification string `json:"userVerification"`
+		} `json:"content"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &begin); err != nil {
+		t.Fatalf("begin: %v %s", err, w.Body)
+	}
+	if begin.Content.UserVerification != "required" {
+		t.Errorf("user verification %q, want required", begin.Content.UserVerification)
+	}
+
+	w = browser.postJSON(finishPasskeyLoginHandler, "/webauthn/login/finish", authenticator.assert(begin.Content.Challenge, userId))
+	if w.Code != http.StatusOK {
+		t.Fatalf("finish: %d %s", w.Code, w.Body)
+	}
+	if signedIn := browser.userId(); signedIn != userId {
+		t.Fatalf("signed in as %q, want %q", signedIn, userId)
+	}
+
+	helper := DBHelper{}
+	if passkey := helper.getPasskey(userId, authenticator.id()); passkey.SignCount != 1 || passkey.LastUsed == 0 {
+		t.Errorf("passkey not updated: %+v", passkey)
+	}
+}
+
+func TestPasskeySignCountRegression(t *testing.T) {
+	setupRedis(t)
+
+	userId := createTestUser(t, "alice", "correct horse battery staple")
+	authenticator := registerTestPasskey(t, userId)
+
+	helper := DBHelper{}
+	challenge := helper.createToken("webauthn", "login ", webauthnChallengeTTL)
+	if helper.authenticatePasskey(authenticator.assert(challenge, userId), "login") != userId {
+		t.Fatalf("login: %v", helper.err)
+	}
+
+	// A clone goes on from the counter it was copied with.
+	authenticator.signCount--
+	challenge = helper.createToken("webauthn", "login ", webauthnChallengeTTL)
+	if helper.authenticatePasskey(authenticator.assert(challenge, userId), "login") != "" || helper.err == nil {
+		t.Fatal("accepted a signature counter which didn't move forward")
+	}
+}
+
+func TestPasskeyLoginRequiresUserVerification(t *testing.T) {
+	setupRedis(t)
+
+	userId := createTestUser(t, "alice", "correct horse battery staple")
+	authenticator := registerTestPasskey(t, userId)
+	authenticator.flags = authDataUserPresent
+
+	helper := DBHelper{}
+	challenge := helper.createToken("webauthn", "login ", webauthnChallengeTTL)
+	if helper.authenticatePasskey(authenticator.assert(challenge, userId), "login") != "" || helper.err == nil {
+		t.Fatal("passwordless login without user verification")
+	}
+
+	// As a second factor after the password, presence is enough.
+	helper.err = nil
+	challenge = helper.createToken("webauthn", "2fa "+userId, webauthnChallengeTTL)
+	if helper.authenticatePasskey(authenticator.assert(challenge, userId), "2fa") != userId {
+		t.Fatalf("second factor: %v", helper.err)
+	}
+}
+
+// Just enough of a CBOR encoder for the attestation objects and COSE keys.
+
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n < 1<<8:
+		return []byte{major<<5 | 24, byte(n)}
+	case n < 1<<16:
+		b := []byte{major<<5 | 25, 0, 0}
+		binary.BigEndian.PutUint16(b[1:], uint16(n))
+		return b
+	}
+	b := []byte{major<<5 | 26, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[1:], uint32(n))
+	return b
+}
+
+func cborInt(v int64) []byte {
+	if v < 0 {
+		return cborHead(1, uint64(-1-v))
+	}
+	return cborHead(0, uint64(v))
+}
+
+func cborBytes(b []byte) []byte {
+	return append(cborHead(2, uint64(len(b))), b...)
+}
+
+func cborText(s string) []byte {
+	return append(cborHead(3, uint64(len(s))), s...)
+}
+
+// cborMap takes the keys and values in turn.
+func cborMap(items ...[]byte) []byte {
+	data := cborHead(5, uint64(len(items)/2))
+	for _, item := range items {
+		data = append(data, item...)
+	}
+	return data
+}